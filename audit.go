@@ -0,0 +1,249 @@
+// SPDX-FileCopyrightText: 2021 Aluísio Augusto Silva Gonçalves <https://aasg.name>
+//
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package snowweb
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// Outcomes of audited actions.
+const (
+	AuditSuccess  = "success"  // The action was performed
+	AuditFailure  = "failure"  // The action was attempted, but failed
+	AuditDenied   = "denied"   // The client was not authorized
+	AuditRejected = "rejected" // The request was invalid or not allowed
+)
+
+// maxAuditRecords is the number of audit records kept in memory to be
+// served by the audit endpoint.
+const maxAuditRecords = 1000
+
+// maxAuditLineSize is the length of the longest line loaded from a
+// previously written audit log.
+const maxAuditLineSize = 1 << 20
+
+// An AuditRecord describes an administrative action requested from the
+// server.
+type AuditRecord struct {
+	// When the action was completed.
+	Time time.Time `json:"time"`
+	// Action requested, e.g. "reload" or "rollback".
+	Action string `json:"action"`
+	// Identity of the client, if it authenticated, in the form
+	// `METHOD:NAME`.
+	Identity string `json:"identity,omitempty"`
+	// Attribute of the identity through which the client was
+	// authorized, if any.
+	Principal string `json:"principal,omitempty"`
+	// Network address of the client.
+	Address string `json:"address,omitempty"`
+	// URL path prefix of the mount the action applied to.
+	Mount string `json:"mount,omitempty"`
+	// Parameters of the request, as sent to the server.
+	Parameters json.RawMessage `json:"parameters,omitempty"`
+	// Store path resulting from the action, if any.
+	Path string `json:"path,omitempty"`
+	// Outcome of the action, one of the Audit* constants.
+	Outcome string `json:"outcome"`
+	// Description of why the action failed, if it did.
+	Error string `json:"error,omitempty"`
+}
+
+// An AuditLog records administrative actions, writing them as JSON
+// lines to a destination and keeping the most recent ones in memory.
+//
+// A nil AuditLog discards all records.
+type AuditLog struct {
+	// Logger writing records to the audit destination.
+	logger zerolog.Logger
+
+	// Most recent records, oldest first.
+	mu      sync.Mutex
+	records []AuditRecord
+}
+
+// NewAuditLog creates an AuditLog writing to w, which is usually
+// obtained from logwriter.JSONWriter.
+func NewAuditLog(w io.Writer) *AuditLog {
+	return &AuditLog{logger: zerolog.New(w)}
+}
+
+// Load reads records previously written by an AuditLog, so that they
+// can be queried.  Lines that are not audit records, or are longer than
+// maxAuditLineSize, are skipped.
+func (l *AuditLog) Load(r io.Reader) error {
+	reader := bufio.NewReaderSize(r, maxAuditLineSize)
+	for {
+		line, isPrefix, err := reader.ReadLine()
+		switch {
+		case errors.Is(err, io.EOF):
+			return nil
+		case err != nil:
+			return fmt.Errorf("snowweb: loading audit log: %w", err)
+		case isPrefix:
+			for isPrefix && err == nil {
+				_, isPrefix, err = reader.ReadLine()
+			}
+			continue
+		}
+
+		var rec AuditRecord
+		if err := json.Unmarshal(line, &rec); err != nil || rec.Action == "" {
+			continue
+		}
+		l.remember(rec)
+	}
+}
+
+// Record writes a record to the audit log.  If its time is not set,
+// the current time is used.
+func (l *AuditLog) Record(rec AuditRecord) {
+	if l == nil {
+		return
+	}
+	if rec.Time.IsZero() {
+		rec.Time = time.Now()
+	}
+	l.remember(rec)
+
+	// Write the fields in the same order as they're marshalled as JSON.
+	event := l.logger.Log().Time("time", rec.Time).Str("action", rec.Action)
+	for _, field := range []struct{ key, value string }{
+		{"identity", rec.Identity},
+		{"principal", rec.Principal},
+		{"address", rec.Address},
+		{"mount", rec.Mount},
+	} {
+		if field.value != "" {
+			event = event.Str(field.key, field.value)
+		}
+	}
+	if len(rec.Parameters) > 0 {
+		event = event.RawJSON("parameters", rec.Parameters)
+	}
+	if rec.Path != "" {
+		event = event.Str("path", rec.Path)
+	}
+	event = event.Str("outcome", rec.Outcome)
+	if rec.Error != "" {
+		event = event.Str("error", rec.Error)
+	}
+	event.Send()
+}
+
+// remember keeps a record in memory, forgetting the oldest ones if
+// there are too many.
+func (l *AuditLog) remember(rec AuditRecord) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.records = append(l.records, rec)
+	if len(l.records) > maxAuditRecords {
+		l.records = append(l.records[:0:0], l.records[len(l.records)-maxAuditRecords:]...)
+	}
+}
+
+// Records returns the records kept in memory, oldest first.
+func (l *AuditLog) Records() []AuditRecord {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]AuditRecord(nil), l.records...)
+}
+
+// audit records an action requested through the API.  The identity
+// may be nil, and params is marshalled as the request parameters
+// unless nil.
+func (h *SnowWebServer) audit(r *http.Request, id *Identity, action, mount string, params interface{}, storePath string, outcome string, err error) {
+	rec := AuditRecord{
+		Action:  action,
+		Address: r.RemoteAddr,
+		Mount:   mount,
+		Path:    storePath,
+		Outcome: outcome,
+	}
+	if id != nil {
+		rec.Identity = id.String()
+		rec.Principal = id.Principal
+	}
+	if params != nil {
+		if data, err := json.Marshal(params); err == nil {
+			rec.Parameters = data
+		}
+	}
+	if err != nil {
+		rec.Error = err.Error()
+	}
+	h.Audit.Record(rec)
+}
+
+// serveAudit responds to a request to the /.snowweb/audit endpoint.
+func (h *SnowWebServer) serveAudit(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Cache-Control", "no-store")
+	w.Header().Add("Vary", "Accept")
+
+	if h.Audit == nil {
+		h.Error(ErrorNotFound, w, r)
+		return
+	}
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Add("Allow", "GET, HEAD")
+		w.Header().Add("Content-Length", "0")
+		w.WriteHeader(http.StatusNotAcceptable)
+		return
+	}
+	if _, ok := h.authorize(w, r, ActionAudit); !ok {
+		return
+	}
+
+	query := r.URL.Query()
+	limit := maxAuditRecords
+	if s := query.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			log.Error().Str("limit", s).Msg("invalid limit in audit log query")
+			h.Error(ErrorBadRequest, w, r)
+			return
+		}
+		limit = n
+	}
+
+	// Filter the records, keeping the most recent ones.
+	var records []AuditRecord
+	for _, rec := range h.Audit.Records() {
+		if (query.Get("action") != "" && rec.Action != query.Get("action")) ||
+			(query.Get("mount") != "" && rec.Mount != query.Get("mount")) ||
+			(query.Get("outcome") != "" && rec.Outcome != query.Get("outcome")) {
+			continue
+		}
+		records = append(records, rec)
+	}
+	if len(records) > limit {
+		records = records[len(records)-limit:]
+	}
+
+	response := struct {
+		Records []AuditRecord `json:"records"`
+	}{records}
+	writeAPIResponse(w, r, response, func(w io.Writer) {
+		for _, rec := range records {
+			identity := rec.Identity
+			if identity == "" {
+				identity = "-"
+			}
+			fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\n", rec.Time.Format(time.RFC3339), rec.Action, rec.Mount, identity, rec.Outcome, rec.Path)
+		}
+	})
+}
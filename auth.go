@@ -0,0 +1,319 @@
+// SPDX-FileCopyrightText: 2021 Aluísio Augusto Silva Gonçalves <https://aasg.name>
+//
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package snowweb
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Errors returned by authenticators.
+var (
+	// ErrNoCredentials is returned by an Authenticator when a request
+	// carries no credentials it can verify.
+	ErrNoCredentials = errors.New("no credentials given")
+	// ErrInvalidCredentials is returned by an Authenticator when a
+	// request carries credentials that fail verification.
+	ErrInvalidCredentials = errors.New("invalid credentials")
+	// ErrRequestTooLarge is returned by an Authenticator when the body
+	// of a request it must verify is larger than the API accepts.
+	ErrRequestTooLarge = errors.New("request body too large")
+)
+
+// HMACScheme is the HTTP authentication scheme of requests signed with
+// HMAC-SHA256.
+const HMACScheme = "SnowWeb-HMAC-SHA256"
+
+// An Identity describes the authenticated client of an API request.
+type Identity struct {
+	// Authentication method used, e.g. "certificate", "token" or
+	// "hmac".
+	Method string
+	// Name identifying the client within the authentication method.
+	Name string
+	// Client certificate presented by the client, if any.
+	Certificate *x509.Certificate
+	// Attribute of the identity through which the client was
+	// authorized, if set by the authorization function.
+	Principal string
+}
+
+func (id *Identity) String() string {
+	return id.Method + ":" + id.Name
+}
+
+// An Authenticator verifies the credentials of API requests.
+type Authenticator interface {
+	// Authenticate returns the identity of the client making a request.
+	//
+	// If the request does not carry credentials for this authenticator,
+	// ErrNoCredentials is returned.  If it does but they can't be
+	// verified, an error wrapping ErrInvalidCredentials is returned.
+	Authenticate(r *http.Request) (*Identity, error)
+	// Challenge returns the value of the WWW-Authenticate header sent
+	// when a request is not authenticated, or an empty string if the
+	// authentication method does not use HTTP authentication.
+	Challenge() string
+}
+
+// ClientCertificateAuthenticator authenticates clients by the TLS
+// client certificate they present, which must have been verified
+// during the TLS handshake.
+//
+// The client is identified by the certificate's subject common name.
+type ClientCertificateAuthenticator struct{}
+
+func (ClientCertificateAuthenticator) Authenticate(r *http.Request) (*Identity, error) {
+	switch {
+	case r.TLS == nil || len(r.TLS.PeerCertificates) == 0:
+		return nil, ErrNoCredentials
+	case len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0:
+		return nil, fmt.Errorf("unverified client certificate: %w", ErrInvalidCredentials)
+	}
+
+	crt := r.TLS.VerifiedChains[0][0]
+	name := crt.Subject.CommonName
+	if name == "" {
+		name = crt.SerialNumber.String()
+	}
+	return &Identity{Method: "certificate", Name: name, Certificate: crt}, nil
+}
+
+func (ClientCertificateAuthenticator) Challenge() string {
+	return ""
+}
+
+// BearerTokenAuthenticator authenticates clients by a static token
+// passed in the Authorization header, as in RFC 6750.
+type BearerTokenAuthenticator struct {
+	// Valid tokens, indexed by the name of the client they identify.
+	Tokens map[string]string
+}
+
+// LoadBearerTokens creates a BearerTokenAuthenticator from a list of
+// files, each containing a single token.  Clients are named after the
+// file their token was read from, without the extension.
+func LoadBearerTokens(filenames ...string) (*BearerTokenAuthenticator, error) {
+	tokens, err := loadSecrets(filenames)
+	if err != nil {
+		return nil, err
+	}
+	return &BearerTokenAuthenticator{Tokens: tokens}, nil
+}
+
+func (a *BearerTokenAuthenticator) Authenticate(r *http.Request) (*Identity, error) {
+	scheme, credentials := splitAuthorization(r)
+	if !strings.EqualFold(scheme, "Bearer") {
+		return nil, ErrNoCredentials
+	}
+
+	for name, token := range a.Tokens {
+		if subtle.ConstantTimeCompare([]byte(credentials), []byte(token)) == 1 {
+			return &Identity{Method: "token", Name: name}, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown bearer token: %w", ErrInvalidCredentials)
+}
+
+func (a *BearerTokenAuthenticator) Challenge() string {
+	return `Bearer realm="SnowWeb"`
+}
+
+// HMACAuthenticator authenticates clients by a signature of the request
+// made with a shared secret key.
+//
+// Requests must carry an Authorization header in the form
+//
+//	SnowWeb-HMAC-SHA256 keyId="ID", timestamp="UNIX", signature="HEX"
+//
+// where the signature is computed as described in SignRequest.
+// Requests whose timestamp deviates from the current time by more than
+// MaxSkew are rejected, and so are repeated signatures within that
+// window, to prevent replay attacks.
+type HMACAuthenticator struct {
+	// Secret keys, indexed by their ID, which also names the client.
+	Keys map[string][]byte
+	// Maximum difference between the request timestamp and the
+	// current time.  If zero, five minutes are allowed.
+	MaxSkew time.Duration
+
+	// Signatures already seen, and when they can be forgotten.
+	seenMu sync.Mutex
+	seen   map[string]time.Time
+}
+
+// LoadHMACKeys creates an HMACAuthenticator from a list of files, each
+// containing a single secret key.  Keys are identified by the name of
+// the file they were read from, without the extension.
+func LoadHMACKeys(filenames ...string) (*HMACAuthenticator, error) {
+	secrets, err := loadSecrets(filenames)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string][]byte, len(secrets))
+	for id, secret := range secrets {
+		keys[id] = []byte(secret)
+	}
+	return &HMACAuthenticator{Keys: keys}, nil
+}
+
+func (a *HMACAuthenticator) Authenticate(r *http.Request) (*Identity, error) {
+	scheme, credentials := splitAuthorization(r)
+	if !strings.EqualFold(scheme, HMACScheme) {
+		return nil, ErrNoCredentials
+	}
+
+	params := parseAuthParams(credentials)
+	key, ok := a.Keys[params["keyId"]]
+	if !ok {
+		return nil, fmt.Errorf("unknown HMAC key %q: %w", params["keyId"], ErrInvalidCredentials)
+	}
+	signature, err := hex.DecodeString(params["signature"])
+	if err != nil {
+		return nil, fmt.Errorf("malformed HMAC signature: %w", ErrInvalidCredentials)
+	}
+	timestamp, err := strconv.ParseInt(params["timestamp"], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("malformed HMAC timestamp: %w", ErrInvalidCredentials)
+	}
+
+	maxSkew := a.MaxSkew
+	if maxSkew == 0 {
+		maxSkew = 5 * time.Minute
+	}
+	now := time.Now()
+	signedAt := time.Unix(timestamp, 0)
+	if signedAt.Before(now.Add(-maxSkew)) || signedAt.After(now.Add(maxSkew)) {
+		return nil, fmt.Errorf("HMAC timestamp out of range: %w", ErrInvalidCredentials)
+	}
+
+	// Read the body so it can be hashed, then put it back in place for
+	// the actual request handler.  Bodies too large to be read whole
+	// are rejected rather than verified and handled cut short.
+	body, err := io.ReadAll(http.MaxBytesReader(nil, r.Body, maxRequestBodySize))
+	if err != nil {
+		if len(body) == maxRequestBodySize {
+			return nil, ErrRequestTooLarge
+		}
+		return nil, err
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	expected := signatureHMAC(key, r.Method, r.URL.RequestURI(), params["timestamp"], body)
+	if !hmac.Equal(signature, expected) {
+		return nil, fmt.Errorf("bad HMAC signature: %w", ErrInvalidCredentials)
+	}
+
+	if !a.remember(params["signature"], signedAt.Add(maxSkew), now) {
+		return nil, fmt.Errorf("replayed HMAC signature: %w", ErrInvalidCredentials)
+	}
+	return &Identity{Method: "hmac", Name: params["keyId"]}, nil
+}
+
+func (a *HMACAuthenticator) Challenge() string {
+	return HMACScheme + ` realm="SnowWeb"`
+}
+
+// remember records a signature as used until the given expiry time,
+// returning false if it was already seen.
+func (a *HMACAuthenticator) remember(signature string, expiry, now time.Time) bool {
+	a.seenMu.Lock()
+	defer a.seenMu.Unlock()
+
+	if a.seen == nil {
+		a.seen = make(map[string]time.Time)
+	}
+	for sig, sigExpiry := range a.seen {
+		if sigExpiry.Before(now) {
+			delete(a.seen, sig)
+		}
+	}
+
+	if _, ok := a.seen[signature]; ok {
+		return false
+	}
+	a.seen[signature] = expiry
+	return true
+}
+
+// SignRequest adds an Authorization header to a request, signing it
+// with an HMAC key.  The body must be the same as the request's.
+//
+// The signature is the hex-encoded HMAC-SHA256 of the request method,
+// request URI, Unix timestamp and the hex-encoded SHA-256 of the body,
+// joined by newlines.
+func SignRequest(r *http.Request, keyID string, key, body []byte, now time.Time) {
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	signature := signatureHMAC(key, r.Method, r.URL.RequestURI(), timestamp, body)
+	r.Header.Set("Authorization", fmt.Sprintf(`%v keyId="%v", timestamp="%v", signature="%x"`, HMACScheme, keyID, timestamp, signature))
+}
+
+// signatureHMAC computes the signature of a request.
+func signatureHMAC(key []byte, method, requestURI, timestamp string, body []byte) []byte {
+	bodyHash := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, key)
+	fmt.Fprintf(mac, "%v\n%v\n%v\n%x", method, requestURI, timestamp, bodyHash)
+	return mac.Sum(nil)
+}
+
+// splitAuthorization splits the Authorization header of a request into
+// the authentication scheme and credentials.
+func splitAuthorization(r *http.Request) (string, string) {
+	split := strings.SplitN(strings.TrimSpace(r.Header.Get("Authorization")), " ", 2)
+	if len(split) != 2 {
+		return split[0], ""
+	}
+	return split[0], strings.TrimSpace(split[1])
+}
+
+// parseAuthParams parses a comma-separated list of `key=value` or
+// `key="value"` authentication parameters.
+func parseAuthParams(s string) map[string]string {
+	params := make(map[string]string)
+	for _, param := range strings.Split(s, ",") {
+		split := strings.SplitN(strings.TrimSpace(param), "=", 2)
+		if len(split) != 2 {
+			continue
+		}
+		params[split[0]] = strings.Trim(split[1], `"`)
+	}
+	return params
+}
+
+// loadSecrets reads secrets from files, each containing a single one,
+// and indexes them by the name of the file without the extension.
+func loadSecrets(filenames []string) (map[string]string, error) {
+	secrets := make(map[string]string, len(filenames))
+	for _, filename := range filenames {
+		data, err := os.ReadFile(filename)
+		if err != nil {
+			return nil, fmt.Errorf("snowweb: reading secret from %v: %w", filename, err)
+		}
+		secret := strings.TrimSpace(string(data))
+		if secret == "" {
+			return nil, fmt.Errorf("snowweb: reading secret from %v: file is empty", filename)
+		}
+
+		name := filepath.Base(filename)
+		name = strings.TrimSuffix(name, filepath.Ext(name))
+		secrets[name] = secret
+	}
+	return secrets, nil
+}
@@ -0,0 +1,188 @@
+// SPDX-FileCopyrightText: 2021 Aluísio Augusto Silva Gonçalves <https://aasg.name>
+//
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package snowweb
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/kevinpollet/nego"
+	"github.com/rs/zerolog/log"
+)
+
+// directoryListingTemplate is the template used to render directory
+// listings as HTML.
+var directoryListingTemplate = template.Must(template.New("autoindex").Parse(`<!DOCTYPE html>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Index of {{.Path}}</title>
+<h1>Index of {{.Path}}</h1>
+<table>
+<thead><tr><th>Name</th><th>Size</th></tr></thead>
+<tbody>
+{{- if ne .Path "/"}}
+<tr><td><a href="../">../</a></td><td></td></tr>
+{{- end}}
+{{- range .Entries}}
+<tr><td><a href="{{.Href}}">{{.Name}}{{if .IsDir}}/{{end}}</a></td><td>{{if not .IsDir}}{{.HumanSize}}{{end}}</td></tr>
+{{- end}}
+</tbody>
+</table>
+`))
+
+// A directoryEntry describes a file in a directory listing.
+type directoryEntry struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	Size int64  `json:"size"`
+}
+
+// IsDir returns true if the entry is a directory.
+func (e directoryEntry) IsDir() bool {
+	return e.Type == "directory"
+}
+
+// Href returns the relative URL of the entry.
+func (e directoryEntry) Href() string {
+	href := (&url.URL{Path: e.Name}).String()
+	if e.IsDir() {
+		href += "/"
+	}
+	return href
+}
+
+// HumanSize returns the size of the entry formatted with binary
+// prefixes.
+func (e directoryEntry) HumanSize() string {
+	const unit = 1024
+	if e.Size < unit {
+		return fmt.Sprintf("%d B", e.Size)
+	}
+	div, exp := int64(unit), 0
+	for n := e.Size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(e.Size)/float64(div), "KMGTPE"[exp])
+}
+
+// autoIndexEnabled checks whether directory listings were enabled
+// for the given URL path.  Prefixes are matched on whole path
+// segments, so that "/artifacts" covers "/artifacts/" but not
+// "/artifacts-private/".
+func (h *NixStorePathServer) autoIndexEnabled(urlPath string) bool {
+	for _, prefix := range h.AutoIndex {
+		if !strings.HasPrefix(urlPath, prefix) {
+			continue
+		}
+		if len(urlPath) == len(prefix) || strings.HasSuffix(prefix, "/") || urlPath[len(prefix)] == '/' {
+			return true
+		}
+	}
+	return false
+}
+
+// serveDirectoryListing responds to a request for a directory without
+// an index.html file with a listing of the directory's contents, either
+// as HTML or JSON depending on the request's Accept header.
+//
+// Hidden files and precompressed siblings of other files are not
+// included in the listing.
+func (h *NixStorePathServer) serveDirectoryListing(w http.ResponseWriter, r *http.Request, dirPath string) {
+	// Make sure relative links in the listing resolve under the
+	// directory.
+	if !strings.HasSuffix(r.URL.Path, "/") {
+		http.Redirect(w, r, path.Base(r.URL.Path)+"/", http.StatusMovedPermanently)
+		return
+	}
+
+	dirEntries, err := fs.ReadDir(h.resolvedRoot, dirPath)
+	if err != nil {
+		log.Error().Err(err).Str("file_path", dirPath).Msg("could not read directory")
+		h.Error(ErrorIO, w, r)
+		return
+	}
+
+	names := make(map[string]bool, len(dirEntries))
+	for _, dirEntry := range dirEntries {
+		names[dirEntry.Name()] = true
+	}
+
+	entries := make([]directoryEntry, 0, len(dirEntries))
+	for _, dirEntry := range dirEntries {
+		name := dirEntry.Name()
+		if strings.HasPrefix(name, ".") {
+			continue
+		}
+		if strings.HasSuffix(name, ".br") && names[strings.TrimSuffix(name, ".br")] {
+			continue
+		}
+
+		// Stat the file through the file system rather than using the
+		// directory entry, so that symbolic links are followed.
+		stat, err := fs.Stat(h.resolvedRoot, path.Join(dirPath, name))
+		if err != nil {
+			log.Warn().Err(err).Str("file_path", path.Join(dirPath, name)).Msg("skipping unreadable directory entry")
+			continue
+		}
+
+		entry := directoryEntry{Name: name, Type: "file", Size: stat.Size()}
+		if stat.IsDir() {
+			entry.Type = "directory"
+			entry.Size = 0
+		}
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].IsDir() != entries[j].IsDir() {
+			return entries[i].IsDir()
+		}
+		return entries[i].Name < entries[j].Name
+	})
+
+	// The listing is rendered in full beforehand so we can leverage
+	// http.ServeContent's support for conditional requests.
+	var body bytes.Buffer
+	var name, etagSuffix string
+	switch nego.NegotiateContentType(r, "text/html", "application/json") {
+	case "application/json":
+		if err := json.NewEncoder(&body).Encode(entries); err != nil {
+			log.Error().Err(err).Str("file_path", dirPath).Msg("could not marshal directory listing")
+			h.Error(ErrorIO, w, r)
+			return
+		}
+		name, etagSuffix = "index.json", "-json"
+	default:
+		data := struct {
+			Path    string
+			Entries []directoryEntry
+		}{r.URL.Path, entries}
+		if err := directoryListingTemplate.Execute(&body, data); err != nil {
+			log.Error().Err(err).Str("file_path", dirPath).Msg("could not render directory listing")
+			h.Error(ErrorIO, w, r)
+			return
+		}
+		name, etagSuffix = "index.html", "-html"
+	}
+	log.Debug().Str("file_path", dirPath).Str("format", name).Msg("sending directory listing")
+
+	// The store path is immutable, so the listing can be cached just
+	// like regular files, as long as each representation gets its own
+	// ETag.
+	var zeroTime time.Time
+	w.Header().Add("Vary", "Accept")
+	w.Header().Add("Cache-Control", "public, max-age=0, proxy-revalidate")
+	w.Header().Add("Etag", strings.TrimSuffix(h.etag, "\"")+etagSuffix+"\"")
+	http.ServeContent(w, r, name, zeroTime, bytes.NewReader(body.Bytes()))
+}
@@ -0,0 +1,223 @@
+// SPDX-FileCopyrightText: 2021 Aluísio Augusto Silva Gonçalves <https://aasg.name>
+//
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"git.sr.ht/~aasg/snowweb/internal/certpool"
+	"github.com/caddyserver/certmagic"
+	"github.com/rs/zerolog/log"
+)
+
+// expiryWarningInterval is how often a warning is logged while the TLS
+// certificate is close to expiring.
+const expiryWarningInterval = 24 * time.Hour
+
+// A fileCertificate is a certificate loaded from the filesystem,
+// together with the CertMagic instance serving it.  Each certificate
+// gets its own CertMagic cache, so that the ones it replaces are
+// dropped instead of being kept, and their OCSP responses refreshed,
+// for as long as the server runs.
+type fileCertificate struct {
+	leaf  *x509.Certificate
+	magic *certmagic.Config
+	cache *certmagic.Cache
+}
+
+// loadFileCert loads the certificate and key from the filesystem and
+// swaps them for the ones loaded before, in a CertMagic cache that
+// staples an OCSP response to the certificate and keeps it fresh.
+// Nothing is changed if the files don't hold a valid keypair.
+func (args *TLSArgs) loadFileCert() error {
+	args.fileMu.Lock()
+	defer args.fileMu.Unlock()
+
+	// Start watching the files before reading them, so that changes
+	// made while reading are picked up.
+	args.certWatcher.Watch(args.Certificate, args.Key)
+	cert, err := tls.LoadX509KeyPair(args.Certificate, args.Key)
+	if err != nil {
+		return err
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return err
+	}
+	// Keep serving a working certificate rather than one that will be
+	// rejected by clients.
+	current, _ := args.fileCert.Load().(*fileCertificate)
+	if current != nil && !time.Now().Before(leaf.NotAfter) && time.Now().Before(current.leaf.NotAfter) {
+		return fmt.Errorf("certificate expired at %v", leaf.NotAfter.Format(time.RFC3339))
+	}
+
+	loaded := &fileCertificate{leaf: leaf}
+	loaded.cache = certmagic.NewCache(certmagic.CacheOptions{
+		GetConfigForCert: func(certmagic.Certificate) (*certmagic.Config, error) {
+			return loaded.magic, nil
+		},
+		Logger: args.magic.Logger,
+	})
+	loaded.magic = certmagic.New(loaded.cache, certmagic.Config{
+		CertSelection: fileCertSelector{leaf},
+		Issuers:       args.magic.Issuers,
+		Storage:       args.magic.Storage,
+		Logger:        args.magic.Logger,
+	})
+	if err := loaded.magic.CacheUnmanagedTLSCertificate(cert, nil); err != nil {
+		loaded.cache.Stop()
+		return err
+	}
+
+	args.fileCert.Store(loaded)
+	if current != nil {
+		current.cache.Stop()
+	}
+	log.Info().Str("path", args.Certificate).Time("expiry", leaf.NotAfter).Msg("loaded TLS certificate")
+	return nil
+}
+
+// getFileCertificate returns the certificate last loaded from the
+// filesystem for a TLS handshake.
+func (args *TLSArgs) getFileCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	current, ok := args.fileCert.Load().(*fileCertificate)
+	if !ok {
+		return nil, errors.New("no TLS certificate loaded")
+	}
+	return current.magic.GetCertificate(hello)
+}
+
+// reloadFileCert reloads the certificate and key after their files
+// change.
+func (args *TLSArgs) reloadFileCert() {
+	log.Info().Str("path", args.Certificate).Msg("TLS certificate files changed, reloading")
+	if err := args.loadFileCert(); err != nil {
+		log.Error().Err(err).Str("path", args.Certificate).Msg("rejected changed TLS certificate, keeping the current one")
+	}
+}
+
+// loadACMERoots loads the CA certificates trusted when connecting to
+// the ACME server, and makes the ACME issuer use them.  Nothing is
+// changed if the file holds no certificates.
+func (args *TLSArgs) loadACMERoots() error {
+	args.rootsWatcher.Watch(args.ACME.CARoots)
+	caPool, err := certpool.LoadX509CertPool(args.ACME.CARoots)
+	if err != nil {
+		return err
+	}
+	args.acmeIssuer.SetRoots(caPool)
+	log.Debug().Str("path", args.ACME.CARoots).Msg("loaded ACME CA roots")
+	return nil
+}
+
+// reloadACMERoots reloads the ACME CA roots after their file changes.
+func (args *TLSArgs) reloadACMERoots() {
+	log.Info().Str("path", args.ACME.CARoots).Msg("ACME CA roots changed, reloading")
+	if err := args.loadACMERoots(); err != nil {
+		log.Error().Err(err).Str("path", args.ACME.CARoots).Msg("rejected changed ACME CA roots, keeping the current ones")
+	}
+}
+
+// MonitorCerts periodically logs a warning while the TLS certificate
+// is due to expire within warnBefore.  It never returns.
+func (args *TLSArgs) MonitorCerts(warnBefore time.Duration) {
+	ticker := time.NewTicker(args.CheckInterval)
+	defer ticker.Stop()
+
+	var lastExpiry, lastWarning time.Time
+	for {
+		expiry := args.CertificateExpiry()
+		if !expiry.Equal(lastExpiry) {
+			// Tell straight away whether a new certificate is also
+			// close to expiring.
+			lastExpiry = expiry
+			lastWarning = time.Time{}
+		}
+		now := time.Now()
+		switch {
+		case expiry.IsZero():
+		case now.Sub(lastWarning) < expiryWarningInterval:
+		case !now.Before(expiry):
+			log.Error().Time("expiry", expiry).Msg("TLS certificate has expired")
+			lastWarning = now
+		case expiry.Sub(now) < warnBefore:
+			log.Warn().Time("expiry", expiry).Msg("TLS certificate expires soon")
+			lastWarning = now
+		}
+
+		<-ticker.C
+	}
+}
+
+// A fileCertSelector makes CertMagic choose a certificate loaded from
+// the filesystem, and nothing else.  It also makes the certificate be
+// used for clients asking for names it's not valid for, as there is no
+// other.
+type fileCertSelector struct {
+	leaf *x509.Certificate
+}
+
+func (s fileCertSelector) SelectCertificate(hello *tls.ClientHelloInfo, choices []certmagic.Certificate) (certmagic.Certificate, error) {
+	for _, choice := range choices {
+		if len(choice.Certificate.Certificate) > 0 && bytes.Equal(choice.Certificate.Certificate[0], s.leaf.Raw) {
+			return choice, nil
+		}
+	}
+	return certmagic.Certificate{}, errors.New("TLS certificate not in cache")
+}
+
+// An acmeIssuer issues certificates through a CertMagic ACME manager
+// that can be replaced to trust other CA roots, as managers keep using
+// the roots they were first used with.
+type acmeIssuer struct {
+	// CertMagic instance the managers are created for.
+	config *certmagic.Config
+	// Current manager, as a *certmagic.ACMEManager.
+	manager atomic.Value
+}
+
+// newACMEIssuer creates an acmeIssuer for a CertMagic instance, with a
+// manager configured after certmagic.DefaultACME.
+func newACMEIssuer(config *certmagic.Config) *acmeIssuer {
+	i := &acmeIssuer{config: config}
+	i.SetRoots(certmagic.DefaultACME.TrustedRoots)
+	return i
+}
+
+// Manager returns the current ACME manager.
+func (i *acmeIssuer) Manager() *certmagic.ACMEManager {
+	return i.manager.Load().(*certmagic.ACMEManager)
+}
+
+// SetRoots replaces the ACME manager with one trusting the given CA
+// roots, or the system's if nil.
+func (i *acmeIssuer) SetRoots(roots *x509.CertPool) {
+	template := certmagic.DefaultACME
+	template.TrustedRoots = roots
+	i.manager.Store(certmagic.NewACMEManager(i.config, template))
+}
+
+func (i *acmeIssuer) PreCheck(ctx context.Context, names []string, interactive bool) error {
+	return i.Manager().PreCheck(ctx, names, interactive)
+}
+
+func (i *acmeIssuer) Issue(ctx context.Context, request *x509.CertificateRequest) (*certmagic.IssuedCertificate, error) {
+	return i.Manager().Issue(ctx, request)
+}
+
+func (i *acmeIssuer) IssuerKey() string {
+	return i.Manager().IssuerKey()
+}
+
+func (i *acmeIssuer) Revoke(ctx context.Context, cert certmagic.CertificateResource, reason int) error {
+	return i.Manager().Revoke(ctx, cert, reason)
+}
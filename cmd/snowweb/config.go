@@ -0,0 +1,335 @@
+// SPDX-FileCopyrightText: 2021 Aluísio Augusto Silva Gonçalves <https://aasg.name>
+//
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/alecthomas/kong"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/sean-/sysexits"
+)
+
+// configSections maps the sections of a configuration file to the
+// prefix of the command-line flags they hold.  Nested sections are
+// named by joining their parent's prefix and their own name.
+var configSections = map[string]string{
+	"site":     "",
+	"tls":      "tls-",
+	"tls-acme": "tls-acme-",
+	"auth":     "auth-",
+	"admin":    "admin-",
+}
+
+// siteFlags lists the flags that are written to the "site" section
+// when printing a configuration.
+var siteFlags = []string{"installable", "profile", "mount", "trusted-key", "autoindex"}
+
+// A configFile holds the values read from a JSON configuration file,
+// indexed by the name of the command-line flag they set.
+//
+// Keys of the file are flag names, optionally within a section that
+// supplies the flag's prefix, e.g. the `--tls-acme-email` flag can be
+// set by
+//
+//	{"tls": {"acme": {"email": "webmaster@example.com"}}}
+//
+// Underscores can be used instead of hyphens, and flags taking lists
+// can be named in the plural, with a trailing "s".  Other keys must
+// match a flag exactly, so that misspellings are reported rather than
+// taken for another flag.
+type configFile struct {
+	// Installable to serve, if given in the file.
+	installable string
+	// Values of the flags set in the file.
+	values map[string]interface{}
+}
+
+// loadConfigFile reads and checks a configuration file against the
+// flags accepted by an application.
+func loadConfigFile(filename string, app *kong.Application) (*configFile, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("loading configuration from %v: %w", filename, err)
+	}
+	defer f.Close()
+
+	cfg, err := parseConfig(f, app)
+	if err != nil {
+		return nil, fmt.Errorf("parsing configuration from %v: %w", filename, err)
+	}
+	return cfg, nil
+}
+
+// parseConfig reads a JSON configuration file.
+func parseConfig(r io.Reader, app *kong.Application) (*configFile, error) {
+	var root map[string]interface{}
+	decoder := json.NewDecoder(r)
+	if err := decoder.Decode(&root); err != nil {
+		return nil, err
+	}
+
+	flags := make(map[string]*kong.Flag)
+	for _, flag := range app.Flags {
+		flags[flag.Name] = flag
+	}
+
+	cfg := &configFile{values: make(map[string]interface{})}
+	if err := cfg.flatten(root, "", "", flags); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// flatten collects the flag values in a section of the configuration
+// file, whose keys are prefixed by prefix.  path is the location of the
+// section in the file, for error messages.
+func (cfg *configFile) flatten(section map[string]interface{}, prefix, path string, flags map[string]*kong.Flag) error {
+	for key, value := range section {
+		name := prefix + strings.ReplaceAll(key, "_", "-")
+		keyPath := path + key
+
+		if name == "installable" {
+			installable, ok := value.(string)
+			if !ok {
+				return fmt.Errorf("%v: expected a string", keyPath)
+			}
+			cfg.installable = installable
+			continue
+		}
+
+		if _, ok := flags[name]; !ok {
+			if flag, ok := flags[strings.TrimSuffix(name, "s")]; ok && isListFlag(flag) {
+				name = flag.Name
+			}
+		}
+		if flag, ok := flags[name]; ok && name != "config" && name != "help" {
+			if _, ok := cfg.values[name]; ok {
+				return fmt.Errorf("%v: %v is set more than once", keyPath, flag.Summary())
+			}
+			cfg.values[name] = value
+			continue
+		}
+
+		if sectionPrefix, ok := configSections[name]; ok {
+			subsection, ok := value.(map[string]interface{})
+			if !ok {
+				return fmt.Errorf("%v: expected an object", keyPath)
+			}
+			if err := cfg.flatten(subsection, sectionPrefix, keyPath+".", flags); err != nil {
+				return err
+			}
+			continue
+		}
+
+		return fmt.Errorf("%v: unknown setting", keyPath)
+	}
+	return nil
+}
+
+// isListFlag checks whether a flag takes a list of values, or a map.
+func isListFlag(flag *kong.Flag) bool {
+	switch flag.Target.Kind() {
+	case reflect.Slice, reflect.Map:
+		return true
+	default:
+		return false
+	}
+}
+
+// Validate is part of kong.Resolver.
+func (cfg *configFile) Validate(app *kong.Application) error {
+	return nil
+}
+
+// Resolve returns the value of a flag set in the configuration file.
+//
+// Values set through environment variables take precedence over those
+// in the file, so they are not resolved here.
+func (cfg *configFile) Resolve(context *kong.Context, parent *kong.Path, flag *kong.Flag) (interface{}, error) {
+	if flag.Tag.Env != "" && os.Getenv(flag.Tag.Env) != "" {
+		return nil, nil
+	}
+	value, ok := cfg.values[flag.Name]
+	if !ok {
+		return nil, nil
+	}
+	// Kong doesn't parse durations given as JSON numbers.
+	if n, ok := value.(float64); ok && flag.Target.Type() == reflect.TypeOf(time.Duration(0)) {
+		return (time.Duration(n) * time.Second).String(), nil
+	}
+	return value, nil
+}
+
+// BeforeResolve loads the configuration file given in the command line
+// or environment, if any, so that flags not set otherwise are taken
+// from it.
+func (args *CLI) BeforeResolve(k *kong.Kong, ctx *kong.Context) error {
+	var configFlag *kong.Flag
+	for _, flag := range k.Model.Flags {
+		if flag.Name == "config" {
+			configFlag = flag
+		}
+	}
+	filename, _ := ctx.FlagValue(configFlag).(string)
+	if filename == "" {
+		return nil
+	}
+
+	cfg, err := loadConfigFile(filename, k.Model)
+	if err != nil {
+		return err
+	}
+	ctx.AddResolver(cfg)
+
+	// The installable is a positional argument, which resolvers don't
+	// handle, so set it here.  It is overwritten if given in the
+	// command line, and was already set if given in the environment.
+	if args.Installable.Ref == "" && cfg.installable != "" {
+		if err := args.Installable.UnmarshalText([]byte(cfg.installable)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// effectiveConfig returns the configuration of the server after
+// parsing, in the format of the configuration file.
+func effectiveConfig(args *CLI, app *kong.Application) map[string]interface{} {
+	root := map[string]interface{}{
+		"site": map[string]interface{}{"installable": args.Installable},
+	}
+
+	// Find the longest section prefix matching each flag, and put its
+	// value there.
+	sectionNames := make([]string, 0, len(configSections))
+	for name := range configSections {
+		sectionNames = append(sectionNames, name)
+	}
+	sort.Slice(sectionNames, func(i, j int) bool {
+		return len(configSections[sectionNames[i]]) > len(configSections[sectionNames[j]])
+	})
+
+	for _, flag := range app.Flags {
+		if flag.Name == "config" || flag.Name == "help" {
+			continue
+		}
+		value := flag.Target.Interface()
+		if d, ok := value.(time.Duration); ok {
+			value = d.String()
+		}
+
+		section, key := root, flag.Name
+		for _, name := range sectionNames {
+			prefix := configSections[name]
+			if (prefix == "" && contains(siteFlags, flag.Name)) || (prefix != "" && strings.HasPrefix(flag.Name, prefix)) {
+				section = configSection(root, name)
+				key = strings.TrimPrefix(flag.Name, prefix)
+				break
+			}
+		}
+		section[key] = value
+	}
+	return root
+}
+
+// configSection returns the object holding a section in a
+// configuration, creating it and its parents if needed.
+func configSection(root map[string]interface{}, name string) map[string]interface{} {
+	section := root
+	for _, part := range strings.Split(name, "-") {
+		child, ok := section[part].(map[string]interface{})
+		if !ok {
+			child = make(map[string]interface{})
+			section[part] = child
+		}
+		section = child
+	}
+	return section
+}
+
+// contains checks whether s is one of the given values.
+func contains(values []string, s string) bool {
+	for _, value := range values {
+		if value == s {
+			return true
+		}
+	}
+	return false
+}
+
+// ConfigCLI represents the command line arguments received by the
+// `snowweb config` subcommand.
+type ConfigCLI struct {
+	Check ConfigCheckCmd `cmd:"" help:"Validate a configuration file and print the effective configuration."`
+}
+
+// ConfigCheckCmd validates a configuration file.
+type ConfigCheckCmd struct {
+	Config string   `arg:"" help:"Path to the configuration file." placeholder:"PATH"`
+	Args   []string `arg:"" optional:"" passthrough:"" help:"Server flags to apply over the configuration file."`
+}
+
+func (cmd *ConfigCheckCmd) Run() error {
+	// Report a missing file as such, rather than as a parsing error.
+	if _, err := os.Stat(cmd.Config); err != nil {
+		return err
+	}
+
+	var args CLI
+	parser, err := newServerParser(&args)
+	if err != nil {
+		return err
+	}
+	if _, err := parser.Parse(append([]string{"--config", cmd.Config}, cmd.Args...)); err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(effectiveConfig(&args, parser.Model), "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(data))
+	return nil
+}
+
+// configMain runs the `snowweb config` subcommand with the given
+// arguments, returning the exit status of the program.
+func configMain(args []string) int {
+	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
+
+	var cli ConfigCLI
+	parser, err := kong.New(&cli,
+		kong.Name("snowweb config"),
+		kong.Description("Manage SnowWeb configuration files."))
+	if err != nil {
+		log.Error().Err(err).Msg("could not set up command-line parser")
+		return sysexits.Software
+	}
+	ctx, err := parser.Parse(args)
+	if err != nil {
+		parser.Errorf("%v", err)
+		return sysexits.Usage
+	}
+
+	if err := ctx.Run(); err != nil {
+		log.Error().Err(err).Msg("invalid configuration")
+		var pathErr *os.PathError
+		if errors.As(err, &pathErr) {
+			return sysexits.NoInput
+		}
+		return sysexits.Config
+	}
+	return sysexits.OK
+}
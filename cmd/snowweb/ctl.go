@@ -0,0 +1,458 @@
+// SPDX-FileCopyrightText: 2021 Aluísio Augusto Silva Gonçalves <https://aasg.name>
+//
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"git.sr.ht/~aasg/snowweb"
+	"git.sr.ht/~aasg/snowweb/internal/certpool"
+	"git.sr.ht/~aasg/snowweb/internal/sockaddr"
+	"github.com/alecthomas/kong"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/sean-/sysexits"
+)
+
+// CtlCLI represents the command line arguments received by the
+// `snowweb ctl` subcommand.
+type CtlCLI struct {
+	Address     string `required:"" help:"Address of the SnowWeb API to connect to." placeholder:"ADDRESS"`
+	JSON        bool   `name:"json" help:"Print responses as JSON."`
+	TokenFile   string `name:"token-file" help:"Path to file with a bearer token to authenticate with." placeholder:"PATH"`
+	HMACKeyFile string `name:"hmac-key-file" help:"Path to file with a secret key to sign requests with." placeholder:"PATH"`
+
+	TLS         bool   `name:"tls" help:"Connect to the API over HTTPS." group:"TLS"`
+	ServerName  string `name:"server-name" help:"Name to verify the server certificate against." placeholder:"NAME" group:"TLS"`
+	Certificate string `name:"certificate" help:"Path to TLS client certificate." placeholder:"PATH" group:"TLS"`
+	Key         string `name:"key" help:"Path to TLS client certificate key." placeholder:"PATH" group:"TLS"`
+	CA          string `name:"ca" help:"Path to CA bundle to verify the server certificate with." placeholder:"PATH" group:"TLS"`
+
+	Status       CtlStatusCmd       `cmd:"" help:"Show what the server is serving."`
+	Reload       CtlReloadCmd       `cmd:"" help:"Rebuild a mounted installable."`
+	Rollback     CtlRollbackCmd     `cmd:"" help:"Switch a mount back to a previous generation."`
+	Generations  CtlGenerationsCmd  `cmd:"" help:"List the generations of a mount."`
+	Logs         CtlLogsCmd         `cmd:"" help:"Show the output of the last build of a mount."`
+	ReloadConfig CtlReloadConfigCmd `cmd:"" name:"reload-config" help:"Re-read the server configuration and apply the changes that don't need a restart."`
+}
+
+// Validate ensures that all command-line flags are internally
+// consistent.
+func (args *CtlCLI) Validate() error {
+	if (args.Certificate != "") != (args.Key != "") {
+		return errors.New("--certificate and --key must be either both given, or both not given")
+	}
+	if args.TokenFile != "" && args.HMACKeyFile != "" {
+		return errors.New("--token-file and --hmac-key-file cannot be both given")
+	}
+	return nil
+}
+
+// CtlStatusCmd queries the /.snowweb/status endpoint.
+type CtlStatusCmd struct{}
+
+func (cmd *CtlStatusCmd) Run(c *ctlClient) error {
+	var response struct {
+		Mounts []struct {
+			Prefix      string `json:"prefix"`
+			Installable string `json:"installable"`
+			Root        string `json:"root"`
+			Generation  int    `json:"generation"`
+		} `json:"mounts"`
+	}
+	if err := c.do("GET", "/.snowweb/status", nil, nil, &response); err != nil || c.json {
+		return err
+	}
+
+	w := tabwriter.NewWriter(c.out, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "MOUNT\tGENERATION\tROOT\tINSTALLABLE\n")
+	for _, m := range response.Mounts {
+		root := m.Root
+		if root == "" {
+			root = "-"
+		}
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\n", m.Prefix, m.Generation, root, m.Installable)
+	}
+	return w.Flush()
+}
+
+// CtlReloadCmd triggers a rebuild through the /.snowweb/reload
+// endpoint.
+type CtlReloadCmd struct {
+	Mount          string            `arg:"" optional:"" default:"/" help:"URL path prefix of the mount to rebuild."`
+	StorePath      string            `name:"store-path" help:"Signed store path to serve instead of building." placeholder:"PATH"`
+	FlakeRef       string            `name:"flake-ref" help:"Flake reference to build instead of the mount's." placeholder:"FLAKEREF"`
+	OverrideInputs map[string]string `name:"override-input" help:"Flake input to override." placeholder:"INPUT=FLAKEREF"`
+	UpdateInputs   []string          `name:"update-input" help:"Flake input to update." placeholder:"INPUT"`
+	DryRun         bool              `name:"dry-run" help:"Only build, without switching to the result."`
+}
+
+func (cmd *CtlReloadCmd) Run(c *ctlClient) error {
+	request := struct {
+		Mount string `json:"mount"`
+		snowweb.RealiseOptions
+	}{
+		Mount: cmd.Mount,
+		RealiseOptions: snowweb.RealiseOptions{
+			StorePath:      cmd.StorePath,
+			FlakeRef:       cmd.FlakeRef,
+			OverrideInputs: cmd.OverrideInputs,
+			UpdateInputs:   cmd.UpdateInputs,
+			DryRun:         cmd.DryRun,
+		},
+	}
+	var response struct {
+		OK    bool   `json:"ok"`
+		Path  string `json:"path"`
+		Root  string `json:"root"`
+		Error string `json:"error"`
+	}
+	if err := c.do("POST", "/.snowweb/reload", nil, request, &response); err != nil {
+		return err
+	}
+
+	switch {
+	case !response.OK:
+		return &ctlError{sysexits.Software, errors.New(response.Error)}
+	case c.json:
+	case cmd.DryRun:
+		fmt.Fprintf(c.out, "built %v\n", response.Path)
+	default:
+		fmt.Fprintf(c.out, "serving %v\n", response.Root)
+	}
+	return nil
+}
+
+// CtlRollbackCmd switches a mount to a previous generation through the
+// /.snowweb/rollback endpoint.
+type CtlRollbackCmd struct {
+	Mount      string `arg:"" optional:"" default:"/" help:"URL path prefix of the mount to roll back."`
+	Generation int    `name:"generation" help:"Generation to switch to, instead of the previous one." placeholder:"NUMBER"`
+}
+
+func (cmd *CtlRollbackCmd) Run(c *ctlClient) error {
+	request := struct {
+		Mount      string `json:"mount"`
+		Generation int    `json:"generation"`
+	}{cmd.Mount, cmd.Generation}
+	var response struct {
+		OK         bool   `json:"ok"`
+		Generation int    `json:"generation"`
+		Root       string `json:"root"`
+		Error      string `json:"error"`
+	}
+	if err := c.do("POST", "/.snowweb/rollback", nil, request, &response); err != nil {
+		return err
+	}
+
+	switch {
+	case !response.OK:
+		return &ctlError{sysexits.Software, errors.New(response.Error)}
+	case !c.json:
+		fmt.Fprintf(c.out, "serving %v (generation %v)\n", response.Root, response.Generation)
+	}
+	return nil
+}
+
+// CtlGenerationsCmd lists the generations of a mount through the
+// /.snowweb/generations endpoint.
+type CtlGenerationsCmd struct {
+	Mount string `arg:"" optional:"" default:"/" help:"URL path prefix of the mount to list generations of."`
+}
+
+func (cmd *CtlGenerationsCmd) Run(c *ctlClient) error {
+	var response struct {
+		Current     int `json:"current"`
+		Generations []struct {
+			Number int       `json:"number"`
+			Path   string    `json:"path"`
+			Time   time.Time `json:"time"`
+		} `json:"generations"`
+	}
+	query := url.Values{"mount": {cmd.Mount}}
+	if err := c.do("GET", "/.snowweb/generations", query, nil, &response); err != nil || c.json {
+		return err
+	}
+
+	w := tabwriter.NewWriter(c.out, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "\tGENERATION\tTIME\tPATH\n")
+	for _, g := range response.Generations {
+		marker := ""
+		if g.Number == response.Current {
+			marker = "*"
+		}
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\n", marker, g.Number, g.Time.Local().Format(time.RFC3339), g.Path)
+	}
+	return w.Flush()
+}
+
+// CtlLogsCmd prints the last build log of a mount, as returned by the
+// /.snowweb/logs endpoint.
+type CtlLogsCmd struct {
+	Mount string `arg:"" optional:"" default:"/" help:"URL path prefix of the mount to show the build log of."`
+}
+
+func (cmd *CtlLogsCmd) Run(c *ctlClient) error {
+	var response struct {
+		Log string `json:"log"`
+	}
+	query := url.Values{"mount": {cmd.Mount}}
+	if err := c.do("GET", "/.snowweb/logs", query, nil, &response); err != nil || c.json {
+		return err
+	}
+	_, err := io.WriteString(c.out, response.Log)
+	return err
+}
+
+// CtlReloadConfigCmd reloads the server configuration through the
+// /.snowweb/config endpoint.
+type CtlReloadConfigCmd struct{}
+
+func (cmd *CtlReloadConfigCmd) Run(c *ctlClient) error {
+	var response struct {
+		OK              bool     `json:"ok"`
+		Applied         []string `json:"applied"`
+		RestartRequired []string `json:"restartRequired"`
+		Error           string   `json:"error"`
+	}
+	if err := c.do("POST", "/.snowweb/config", nil, nil, &response); err != nil {
+		return err
+	}
+
+	switch {
+	case !response.OK:
+		return &ctlError{sysexits.Config, errors.New(response.Error)}
+	case c.json:
+		return nil
+	}
+	if len(response.Applied) > 0 {
+		fmt.Fprintf(c.out, "applied %v\n", strings.Join(response.Applied, ", "))
+	}
+	if len(response.RestartRequired) > 0 {
+		fmt.Fprintf(c.out, "restart required for %v\n", strings.Join(response.RestartRequired, ", "))
+	}
+	return nil
+}
+
+// A ctlError is an error that causes `snowweb ctl` to exit with a
+// specific status.
+type ctlError struct {
+	// Exit status, as defined in sysexits.
+	status int
+	err    error
+}
+
+func (e *ctlError) Error() string {
+	return e.err.Error()
+}
+
+func (e *ctlError) Unwrap() error {
+	return e.err
+}
+
+// A ctlClient makes requests to the SnowWeb API.
+type ctlClient struct {
+	// HTTP client connecting to the server.
+	client *http.Client
+	// Base URL of the requests.
+	baseURL string
+	// Bearer token to authenticate with, if any.
+	token string
+	// Key to sign requests with, and its ID, if any.
+	hmacKeyID string
+	hmacKey   []byte
+	// Whether to print responses as received, in JSON.
+	json bool
+	// Where to print responses to.
+	out io.Writer
+}
+
+// newCtlClient creates a ctlClient from the command-line arguments.
+func newCtlClient(args *CtlCLI) (*ctlClient, error) {
+	c := &ctlClient{json: args.JSON, out: os.Stdout}
+
+	// The API address may not be a TCP address, so the URL host is
+	// only used for virtual hosting and server name verification.
+	host := args.ServerName
+	if host == "" {
+		host = "localhost"
+	}
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return sockaddr.ConnFromStringContext(ctx, args.Address)
+		},
+	}
+	c.baseURL = "http://" + host
+	if args.TLS {
+		c.baseURL = "https://" + host
+		transport.TLSClientConfig = &tls.Config{ServerName: args.ServerName}
+		if args.CA != "" {
+			pool, err := certpool.LoadX509CertPool(args.CA)
+			if err != nil {
+				return nil, err
+			}
+			transport.TLSClientConfig.RootCAs = pool
+		}
+		if args.Certificate != "" {
+			crt, err := tls.LoadX509KeyPair(args.Certificate, args.Key)
+			if err != nil {
+				return nil, fmt.Errorf("loading client certificate from %v: %w", args.Certificate, err)
+			}
+			transport.TLSClientConfig.Certificates = []tls.Certificate{crt}
+		}
+	}
+	c.client = &http.Client{Transport: transport}
+
+	if args.TokenFile != "" {
+		token, err := readSecretFile(args.TokenFile)
+		if err != nil {
+			return nil, err
+		}
+		c.token = token
+	}
+	if args.HMACKeyFile != "" {
+		key, err := readSecretFile(args.HMACKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		// Keys are named after their file, like in the server.
+		name := filepath.Base(args.HMACKeyFile)
+		c.hmacKeyID = strings.TrimSuffix(name, filepath.Ext(name))
+		c.hmacKey = []byte(key)
+	}
+	return c, nil
+}
+
+// readSecretFile reads a secret from a file, without surrounding
+// whitespace.
+func readSecretFile(filename string) (string, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return "", fmt.Errorf("reading secret from %v: %w", filename, err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// do sends an API request, with the given query string and, if not
+// nil, a JSON body, and decodes the JSON response into response.
+//
+// If the client was asked to print JSON, the response is also printed
+// as received.  Failures are reported as a ctlError.
+func (c *ctlClient) do(method, path string, query url.Values, body, response interface{}) error {
+	var bodyData []byte
+	if body != nil {
+		var err error
+		if bodyData, err = json.Marshal(body); err != nil {
+			return &ctlError{sysexits.Software, err}
+		}
+	}
+
+	u := c.baseURL + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequest(method, u, bytes.NewReader(bodyData))
+	if err != nil {
+		return &ctlError{sysexits.Software, err}
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	switch {
+	case c.token != "":
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	case c.hmacKey != nil:
+		snowweb.SignRequest(req, c.hmacKeyID, c.hmacKey, bodyData, time.Now())
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return &ctlError{sysexits.Unavailable, err}
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return &ctlError{sysexits.IOErr, err}
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		err := fmt.Errorf("server responded with %v", resp.Status)
+		switch resp.StatusCode {
+		case http.StatusBadRequest:
+			return &ctlError{sysexits.DataErr, err}
+		case http.StatusUnauthorized, http.StatusForbidden:
+			return &ctlError{sysexits.NoPerm, err}
+		case http.StatusNotFound:
+			return &ctlError{sysexits.NoInput, err}
+		case http.StatusServiceUnavailable:
+			return &ctlError{sysexits.Unavailable, err}
+		default:
+			if resp.StatusCode >= 500 {
+				return &ctlError{sysexits.Software, err}
+			}
+			return &ctlError{sysexits.Protocol, err}
+		}
+	}
+	if err := json.Unmarshal(data, response); err != nil {
+		return &ctlError{sysexits.Protocol, fmt.Errorf("parsing response: %w", err)}
+	}
+
+	if c.json {
+		c.out.Write(data)
+		fmt.Fprintln(c.out)
+	}
+	return nil
+}
+
+// ctlMain runs the `snowweb ctl` subcommand with the given arguments,
+// returning the exit status of the program.
+func ctlMain(args []string) int {
+	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
+
+	var cli CtlCLI
+	parser, err := kong.New(&cli,
+		kong.Name("snowweb ctl"),
+		kong.Description("Control a running SnowWeb server through its API."),
+		kong.PostBuild(defaultEnv{"SNOWWEB_CTL_"}.Apply))
+	if err != nil {
+		log.Error().Err(err).Msg("could not set up command-line parser")
+		return sysexits.Software
+	}
+	ctx, err := parser.Parse(args)
+	if err != nil {
+		parser.Errorf("%v", err)
+		return sysexits.Usage
+	}
+
+	client, err := newCtlClient(&cli)
+	if err != nil {
+		log.Error().Err(err).Msg("could not set up API client")
+		return sysexits.NoInput
+	}
+	if err := ctx.Run(client); err != nil {
+		log.Error().Err(err).Str("command", ctx.Command()).Msg("command failed")
+		var ctlErr *ctlError
+		if errors.As(err, &ctlErr) {
+			return ctlErr.status
+		}
+		return sysexits.Software
+	}
+	return sysexits.OK
+}
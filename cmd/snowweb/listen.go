@@ -0,0 +1,230 @@
+// SPDX-FileCopyrightText: 2021 Aluísio Augusto Silva Gonçalves <https://aasg.name>
+//
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"git.sr.ht/~aasg/snowweb"
+	"git.sr.ht/~aasg/snowweb/internal/sockaddr"
+)
+
+// Roles a listener can have, defining what it serves.
+const (
+	roleSite     = "site"     // The website and, unless there's an admin listener, the API
+	roleAdmin    = "admin"    // The API only
+	roleMetrics  = "metrics"  // The metrics endpoint only
+	roleRedirect = "redirect" // A redirect from HTTP to HTTPS
+)
+
+// A listenSpec describes a listening socket and how connections to it
+// are served.  It is written as `ADDRESS[,OPTION...]`, where options
+// are a role, "tls" or "plain", and "proxy", e.g.
+//
+//	tcp:[::]:443,tls
+//	unix:/run/snowweb/admin.sock,admin
+//	systemd:metrics,metrics,proxy
+//	tcp:[::]:80,redirect
+type listenSpec struct {
+	// Address to listen at, in the format accepted by
+	// sockaddr.ListenerFromString.
+	Address string
+	// What is served through the listener, one of the role* constants.
+	Role string
+	// Whether connections are or aren't secured with TLS.  If neither
+	// is set, site listeners use TLS if a certificate is configured,
+	// and other listeners don't.
+	TLS, Plain bool
+	// Whether clients send a PROXY protocol header before the
+	// connection's data.
+	Proxy bool
+}
+
+func (spec *listenSpec) UnmarshalText(text []byte) error {
+	split := strings.Split(string(text), ",")
+	*spec = listenSpec{Address: split[0], Role: roleSite}
+	if _, _, err := sockaddr.SplitNetworkAddress(spec.Address); err != nil {
+		return err
+	}
+
+	roleSet := false
+	for _, option := range split[1:] {
+		switch option {
+		case roleSite, roleAdmin, roleMetrics, roleRedirect:
+			if roleSet {
+				return fmt.Errorf("listener %v: more than one role given", spec.Address)
+			}
+			spec.Role, roleSet = option, true
+		case "tls":
+			spec.TLS = true
+		case "plain":
+			spec.Plain = true
+		case "proxy":
+			spec.Proxy = true
+		default:
+			return fmt.Errorf("listener %v: unknown option %q", spec.Address, option)
+		}
+	}
+	if spec.TLS && spec.Plain {
+		return fmt.Errorf("listener %v: tls and plain cannot be both given", spec.Address)
+	}
+	if spec.TLS && spec.Role == roleRedirect {
+		return fmt.Errorf("listener %v: redirect listeners only serve plain HTTP", spec.Address)
+	}
+	return nil
+}
+
+func (spec listenSpec) MarshalText() ([]byte, error) {
+	return []byte(spec.String()), nil
+}
+
+func (spec listenSpec) String() string {
+	s := spec.Address
+	if spec.Role != roleSite {
+		s += "," + spec.Role
+	}
+	if spec.TLS {
+		s += ",tls"
+	}
+	if spec.Plain {
+		s += ",plain"
+	}
+	if spec.Proxy {
+		s += ",proxy"
+	}
+	return s
+}
+
+// Port returns the TCP port of the listener, or 0 if it doesn't listen
+// at a known TCP port.
+func (spec *listenSpec) Port() int {
+	network, address, _ := sockaddr.SplitNetworkAddress(spec.Address)
+	if !strings.HasPrefix(network, "tcp") {
+		return 0
+	}
+	_, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return 0
+	}
+	n, _ := strconv.Atoi(port)
+	return n
+}
+
+// UsesTLS checks whether connections to the listener are secured with
+// TLS, given whether a TLS certificate is configured.
+func (spec *listenSpec) UsesTLS(tlsEnabled bool) bool {
+	return spec.TLS || (tlsEnabled && spec.Role == roleSite && !spec.Plain)
+}
+
+// Listen creates the listening socket, or takes the one passed by the
+// server process this one is replacing, if any.
+func (spec *listenSpec) Listen(inherited *upgradeState) (net.Listener, error) {
+	listener, err := inherited.Listener(spec.Address)
+	if listener != nil || err != nil {
+		return listener, err
+	}
+	return sockaddr.ListenerFromString(spec.Address)
+}
+
+// Wrap sets up a listening socket created by Listen to accept
+// connections as described by the spec.  If the listener uses TLS,
+// connections are secured according to tlsConfig, which must not be
+// nil then.  If it accepts PROXY protocol headers, only clients in
+// proxySources are trusted to send them, unless it's empty.
+func (spec *listenSpec) Wrap(listener net.Listener, tlsConfig *tls.Config, proxySources []ipNetwork) net.Listener {
+	// The PROXY protocol header comes before the TLS handshake.
+	if spec.Proxy {
+		trusted := make([]*net.IPNet, len(proxySources))
+		for i := range proxySources {
+			trusted[i] = (*net.IPNet)(&proxySources[i])
+		}
+		listener = &sockaddr.ProxyListener{Listener: listener, Trusted: trusted}
+	}
+	if spec.UsesTLS(tlsConfig != nil) {
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+	return listener
+}
+
+// An ipNetwork is an IP network, written in CIDR notation or as a
+// single address.
+type ipNetwork net.IPNet
+
+func (n *ipNetwork) UnmarshalText(text []byte) error {
+	network, err := sockaddr.ParseIPNetwork(string(text))
+	if err != nil {
+		return err
+	}
+	*n = ipNetwork(*network)
+	return nil
+}
+
+func (n ipNetwork) MarshalText() ([]byte, error) {
+	return []byte(n.String()), nil
+}
+
+func (n ipNetwork) String() string {
+	network := net.IPNet(n)
+	return network.String()
+}
+
+// A trustedProxy is a network of reverse proxies trusted to report the
+// original client of requests, written as an IP network or "unix" for
+// clients of Unix domain sockets, followed by "=" and the family of
+// headers the proxies set, one of the snowweb.Header* constants.
+type trustedProxy struct {
+	Network ipNetwork
+	Unix    bool
+	Headers string
+}
+
+func (p *trustedProxy) UnmarshalText(text []byte) error {
+	*p = trustedProxy{}
+	split := strings.Split(string(text), "=")
+	if len(split) != 2 {
+		return fmt.Errorf("trusted proxy %q must be followed by =%v or =%v", text, snowweb.HeaderForwarded, snowweb.HeaderXForwarded)
+	}
+	switch split[1] {
+	case snowweb.HeaderForwarded, snowweb.HeaderXForwarded:
+		p.Headers = split[1]
+	default:
+		return fmt.Errorf("unknown forwarding headers %q", split[1])
+	}
+	if split[0] == "unix" {
+		p.Unix = true
+		return nil
+	}
+	return p.Network.UnmarshalText([]byte(split[0]))
+}
+
+func (p trustedProxy) MarshalText() ([]byte, error) {
+	return []byte(p.String()), nil
+}
+
+func (p trustedProxy) String() string {
+	if p.Unix {
+		return "unix=" + p.Headers
+	}
+	return p.Network.String() + "=" + p.Headers
+}
+
+// newForwardedHandler wraps an http.Handler to take the original client
+// of requests from the headers set by the given reverse proxies.
+func newForwardedHandler(h http.Handler, proxies []trustedProxy) *snowweb.ForwardedHandler {
+	forwarded := &snowweb.ForwardedHandler{Handler: h}
+	for i := range proxies {
+		proxy := snowweb.TrustedProxy{Headers: proxies[i].Headers}
+		if !proxies[i].Unix {
+			proxy.Network = (*net.IPNet)(&proxies[i].Network)
+		}
+		forwarded.Proxies = append(forwarded.Proxies, proxy)
+	}
+	return forwarded
+}
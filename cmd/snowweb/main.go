@@ -5,19 +5,22 @@
 package main
 
 import (
-	"context"
 	"crypto/tls"
 	"errors"
+	"fmt"
+	"io/fs"
 	stdlog "log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"runtime/debug"
 	"strings"
 	"time"
 
 	"git.sr.ht/~aasg/snowweb"
-	"git.sr.ht/~aasg/snowweb/internal/certpool"
 	"git.sr.ht/~aasg/snowweb/internal/logwriter"
+	"git.sr.ht/~aasg/snowweb/internal/nix"
 	"git.sr.ht/~aasg/snowweb/internal/sockaddr"
 	"github.com/alecthomas/kong"
 	"github.com/rs/zerolog"
@@ -28,31 +31,196 @@ import (
 
 // CLI represents the command line arguments received by the program.
 type CLI struct {
-	Installable string `arg required help:"Package to serve."`
-	Profile     string `help:"Nix profile to update with the built website." placeholder:"PATH"`
+	Config          string                         `help:"Path to JSON configuration file, overridden by environment variables and flags." placeholder:"PATH"`
+	Installable     snowweb.Installable            `arg:"" optional:"" help:"Package to serve, optionally followed by ^OUTPUT or ^OUTPUT/SUBPATH."`
+	Profile         string                         `help:"Nix profile to update with the built website." placeholder:"PATH"`
+	Mounts          map[string]snowweb.Installable `name:"mount" help:"Additional package to serve under a URL path prefix." placeholder:"PREFIX=INSTALLABLE"`
+	TrustedKeys     []string                       `name:"trusted-key" help:"Public key trusted to sign store paths served without being built." placeholder:"NAME:KEY"`
+	BackgroundBuild bool                           `name:"background-build" help:"Serve what the Nix profile points to, or the fallback path, while performing the initial build in the background."`
+	FallbackPath    string                         `name:"fallback-path" help:"Store path to serve while performing the initial build in the background, if the profile doesn't point to one." placeholder:"PATH"`
 
-	ListenAddress string `name:"listen" default:"tcp:[::1]:" help:"Address to listen at." placeholder:"ADDRESS"`
-	Log           string `default:"stderr" help:"Where to write log messages to." placeholder:"ADDRESS"`
-	Debug         bool   `default:"false" help:"Whether to enable debug logging."`
-	ClientCA      string `help:"Path to TLS client CA bundle." placeholder:"PATH"`
+	Listeners         []listenSpec   `name:"listen" default:"tcp:[::1]:" sep:" " help:"Address to listen at, followed by a role (site, admin, metrics or redirect), tls or plain, and proxy, separated by commas." placeholder:"ADDRESS[,OPTION...]"`
+	ProxySources      []ipNetwork    `name:"proxy-source" help:"Network trusted to send PROXY protocol headers to listeners with the proxy option.  Required for TCP listeners with the proxy option." placeholder:"CIDR"`
+	TrustedProxies    []trustedProxy `name:"trusted-proxy" help:"Network of reverse proxies trusted to report the client address, scheme and host, or unix for clients of Unix domain sockets, followed by =forwarded or =x-forwarded for the headers they set." placeholder:"CIDR=HEADERS"`
+	Log               string         `default:"stderr" help:"Where to write log messages to." placeholder:"ADDRESS"`
+	Debug             bool           `default:"false" help:"Whether to enable debug logging."`
+	AuditLog          string         `name:"audit-log" help:"Where to write the audit log of administrative actions to." placeholder:"ADDRESS"`
+	ClientCA          string         `help:"Path to TLS client CA bundle." placeholder:"PATH"`
+	TokenFiles        []string       `name:"auth-token-file" help:"Path to file with a bearer token accepted for API requests." placeholder:"PATH"`
+	HMACKeyFiles      []string       `name:"auth-hmac-key-file" help:"Path to file with a secret key accepted for signing API requests." placeholder:"PATH"`
+	AuthPolicy        string         `name:"auth-policy" help:"Path to JSON file with the authorization policy for API requests." placeholder:"PATH"`
+	AutoIndex         []string       `name:"autoindex" help:"URL path prefix under which to list directories without an index.html." placeholder:"PREFIX"`
+	UpgradeExecutable string         `name:"upgrade-executable" help:"Program to hand over to on SIGRTMIN+1, instead of the one the server was started as." placeholder:"PATH"`
 
-	TLS TLSArgs `embed prefix:"tls-"`
+	AllowFlakeRefs      []string `name:"allow-flake-ref" help:"Prefix of flake references remote rebuild requests may use." placeholder:"FLAKEREF" group:"Remote rebuilds"`
+	AllowOverrideInputs []string `name:"allow-override-input" help:"Flake input remote rebuild requests may override." placeholder:"INPUT" group:"Remote rebuilds"`
+	AllowUpdateInputs   []string `name:"allow-update-input" help:"Flake input remote rebuild requests may update." placeholder:"INPUT" group:"Remote rebuilds"`
+
+	RateLimit         float64       `name:"rate-limit" default:"5" help:"API requests allowed per second from each address, or 0 for no limit." placeholder:"RATE" group:"Rate limiting"`
+	RateBurst         int           `name:"rate-burst" default:"20" help:"API requests allowed at once from each address." placeholder:"COUNT" group:"Rate limiting"`
+	IdentityRateLimit float64       `name:"identity-rate-limit" default:"1" help:"API requests allowed per second from each authenticated client, or 0 for no limit." placeholder:"RATE" group:"Rate limiting"`
+	IdentityRateBurst int           `name:"identity-rate-burst" default:"10" help:"API requests allowed at once from each authenticated client." placeholder:"COUNT" group:"Rate limiting"`
+	LockoutThreshold  int           `name:"lockout-threshold" default:"10" help:"Failed API authentication attempts after which an address is locked out, or 0 to disable lockouts." placeholder:"COUNT" group:"Rate limiting"`
+	LockoutDuration   time.Duration `name:"lockout-duration" default:"15m" help:"How long addresses are locked out for." placeholder:"DURATION" group:"Rate limiting"`
+
+	HealthzChecks    []string      `name:"healthz-check" default:"generation" help:"Criterion checked by the healthz endpoint: generation, build, certificate or draining." placeholder:"CHECK" group:"Health checks"`
+	ReadyzChecks     []string      `name:"readyz-check" default:"generation,draining" help:"Criterion checked by the readyz endpoint: generation, build, certificate or draining." placeholder:"CHECK" group:"Health checks"`
+	HealthBuildGrace time.Duration `name:"health-build-grace" default:"0s" help:"How long builds may keep failing before the build check fails." placeholder:"DURATION" group:"Health checks"`
+	HealthCertDays   int           `name:"health-cert-days" default:"7" help:"Days the TLS certificate must remain valid for the certificate check to pass, and before warnings are logged." placeholder:"DAYS" group:"Health checks"`
+
+	DrainDelay     time.Duration `name:"drain-delay" default:"0s" help:"How long to keep serving while reporting the server as draining before shutting down." placeholder:"DURATION" group:"Shutdown"`
+	DrainTimeout   time.Duration `name:"drain-timeout" default:"30s" help:"How long to wait for requests and builds to finish when shutting down before closing connections and canceling builds, or 0 to wait forever." placeholder:"DURATION" group:"Shutdown"`
+	ShutdownBuilds string        `name:"shutdown-builds" default:"wait" enum:"wait,cancel,detach" help:"What to do with running builds when shutting down: wait for them, cancel them, or detach from them." placeholder:"POLICY" group:"Shutdown"`
+
+	AdminListenAddress string `name:"admin-listen" help:"Address to serve the API at, instead of alongside the website.  Same as --listen ADDRESS,admin." placeholder:"ADDRESS" group:"Admin API"`
+	AdminUIDs          []int  `name:"admin-uid" help:"User ID allowed to use the API through a Unix domain socket." placeholder:"UID" group:"Admin API"`
+	AdminGIDs          []int  `name:"admin-gid" help:"Group ID allowed to use the API through a Unix domain socket." placeholder:"GID" group:"Admin API"`
+
+	TLS TLSArgs `embed:"" prefix:"tls-"`
 }
 
 // Validate ensures that the all command-line flags are internally
 // consistent.
 func (args *CLI) Validate() error {
+	if args.Installable.Ref == "" {
+		return errors.New("an installable must be given in the command line or configuration file")
+	}
 	if err := args.TLS.Validate(); err != nil {
 		return err
 	}
 
+	listeners, err := args.listeners()
+	if err != nil {
+		return err
+	}
+	for _, spec := range listeners {
+		if spec.TLS && !args.TLS.Enabled() {
+			return fmt.Errorf("listener %v uses TLS, but no certificate is configured", spec.Address)
+		}
+		if spec.Role == roleRedirect && !args.TLS.Enabled() {
+			return fmt.Errorf("listener %v redirects to HTTPS, but no certificate is configured", spec.Address)
+		}
+		network, _, _ := sockaddr.SplitNetworkAddress(spec.Address)
+		if spec.Proxy && strings.HasPrefix(network, "tcp") && len(args.ProxySources) == 0 {
+			return fmt.Errorf("listener %v accepts PROXY protocol headers, but no --proxy-source is trusted to send them", spec.Address)
+		}
+		if network == "unix" {
+			if err := args.checkPeerCredentials(spec); err != nil {
+				return err
+			}
+		}
+	}
+
+	if args.FallbackPath != "" {
+		if !args.BackgroundBuild {
+			return errors.New("a fallback path is only served with --background-build")
+		}
+		if !nix.IsStorePath(args.FallbackPath) {
+			return fmt.Errorf("fallback path %v is not a Nix store path", args.FallbackPath)
+		}
+	}
+
+	for _, key := range args.TrustedKeys {
+		if _, err := nix.ParsePublicKey(key); err != nil {
+			return err
+		}
+	}
+
+	for _, check := range append(args.HealthzChecks[:len(args.HealthzChecks):len(args.HealthzChecks)], args.ReadyzChecks...) {
+		switch check {
+		case healthGeneration, healthBuild, healthCertificate, healthDraining:
+		default:
+			return fmt.Errorf("unknown health check %q", check)
+		}
+	}
+
 	return nil
 }
 
+// Health checks that can be given to --healthz-check and --readyz-check.
+const (
+	healthGeneration  = "generation"  // Every mount is serving a generation
+	healthBuild       = "build"       // The last build of every mount succeeded
+	healthCertificate = "certificate" // The TLS certificate remains valid long enough
+	healthDraining    = "draining"    // The server is not shutting down
+)
+
+// checkPeerCredentials ensures that clients of a listener bound to a
+// Unix domain socket can be authenticated by --admin-uid and
+// --admin-gid, if they're given.  Peer credentials can only be read
+// from the socket itself, and would be those of the proxy if there's
+// one.
+func (args *CLI) checkPeerCredentials(spec listenSpec) error {
+	if spec.Role != roleAdmin || len(args.AdminUIDs) == 0 && len(args.AdminGIDs) == 0 {
+		return nil
+	}
+	if spec.Proxy || spec.UsesTLS(args.TLS.Enabled()) {
+		return fmt.Errorf("admin listener %v authenticates clients by --admin-uid and --admin-gid, so it cannot use TLS or the PROXY protocol", spec.Address)
+	}
+	return nil
+}
+
+// healthCertValidity returns how long the TLS certificate must remain
+// valid for before it's reported as expiring.
+func (args *CLI) healthCertValidity() time.Duration {
+	return time.Duration(args.HealthCertDays) * 24 * time.Hour
+}
+
+// healthCriteria returns the criteria for the given health checks.
+func (args *CLI) healthCriteria(checks []string) snowweb.HealthCriteria {
+	criteria := snowweb.HealthCriteria{
+		BuildGracePeriod:    args.HealthBuildGrace,
+		CertificateValidity: args.healthCertValidity(),
+	}
+	for _, check := range checks {
+		switch check {
+		case healthGeneration:
+			criteria.Generation = true
+		case healthBuild:
+			criteria.Build = true
+		case healthCertificate:
+			criteria.Certificate = true
+		case healthDraining:
+			criteria.Draining = true
+		}
+	}
+	return criteria
+}
+
+// listeners returns the listeners given in the command line, including
+// the admin listener, if any.
+func (args *CLI) listeners() ([]listenSpec, error) {
+	listeners := args.Listeners
+	if args.AdminListenAddress != "" {
+		var spec listenSpec
+		if err := spec.UnmarshalText([]byte(args.AdminListenAddress)); err != nil {
+			return nil, err
+		}
+		spec.Role = roleAdmin
+		listeners = append(listeners[:len(listeners):len(listeners)], spec)
+	}
+	return listeners, nil
+}
+
 var cliArgs CLI
 
 func main() {
-	kong.Parse(&cliArgs, TLSVars, kong.PostBuild(defaultEnv{"SNOWWEB_"}.Apply))
+	// Kong cannot mix positional arguments with subcommands, so the
+	// client subcommand is dispatched before parsing the server's
+	// arguments, which keep working without a subcommand.
+	if len(os.Args) > 1 && os.Args[1] == "ctl" {
+		os.Exit(ctlMain(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "config" {
+		os.Exit(configMain(os.Args[2:]))
+	}
+
+	parser, err := newServerParser(&cliArgs)
+	if err != nil {
+		panic(err)
+	}
+	_, err = parser.Parse(os.Args[1:])
+	parser.FatalIfErrorf(err)
 
 	// Set up zerolog to write to stderr by default, then switch to
 	// whatever the user requests, for consistency in how we report
@@ -74,64 +242,208 @@ func main() {
 	stdlog.SetFlags(0)
 	stdlog.SetOutput(log.Logger)
 
-	listener, err := sockaddr.ListenerFromString(cliArgs.ListenAddress)
-	if err != nil {
-		log.Error().Err(err).Str("address", cliArgs.ListenAddress).Msg("could not create listening socket")
-		os.Exit(sysexits.Unavailable)
+	// Find where the website is served through HTTPS and, if requests
+	// to plain HTTP are redirected there, have ACME challenges answered
+	// at the redirect listener.
+	specs, _ := cliArgs.listeners()
+	httpsPort := 0
+	for _, spec := range specs {
+		if spec.Role == roleSite && spec.UsesTLS(cliArgs.TLS.Enabled()) && httpsPort == 0 {
+			httpsPort = spec.Port()
+		}
+		if spec.Role == roleRedirect {
+			port := spec.Port()
+			if port == 0 {
+				// Assume sockets passed in are bound to the default port.
+				port = 80
+			}
+			cliArgs.TLS.EnableHTTPChallenge(port)
+		}
 	}
 
+	// Client certificates are verified against a pool of CAs that can
+	// be changed when reloading the configuration.
+	clientCAs := &clientCAPool{}
+	var tlsConfig *tls.Config
 	if cliArgs.TLS.Enabled() {
 		if err := cliArgs.TLS.Init(); err != nil {
 			log.Error().Err(err).Msg("could not initialize TLS parameters")
 			os.Exit(sysexits.Usage)
 		}
-		tlsConfig := cliArgs.TLS.Config()
+		tlsConfig = cliArgs.TLS.Config()
+		clientCAs.Apply(tlsConfig)
+	}
 
-		if cliArgs.ClientCA != "" {
-			clientCAPool, err := certpool.LoadX509CertPool(cliArgs.ClientCA)
-			if err != nil {
-				log.Error().Err(err).Str("path", cliArgs.ClientCA).Msg("could not read client CA bundle")
-				os.Exit(sysexits.DataErr)
-			}
+	// If this process is replacing another server, take over its
+	// sockets and what it was serving.
+	inherited, err := inheritedState()
+	if err != nil {
+		log.Error().Err(err).Msg("could not read state passed by previous server process")
+		os.Exit(sysexits.Software)
+	}
 
-			tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
-			tlsConfig.ClientCAs = clientCAPool
-			log.Debug().Str("ca_path", cliArgs.ClientCA).Msg("enabled client certificate verification")
+	sockets := make([]net.Listener, len(specs))
+	listeners := make([]net.Listener, len(specs))
+	hasAdminListener := false
+	for i, spec := range specs {
+		sockets[i], err = spec.Listen(inherited)
+		if err != nil {
+			log.Error().Err(err).Str("address", spec.Address).Str("role", spec.Role).Msg("could not create listening socket")
+			os.Exit(sysexits.Unavailable)
 		}
-
-		listener = tls.NewListener(listener, tlsConfig)
+		// Sockets passed by systemd are only known to be Unix domain
+		// sockets once they're received.
+		if _, ok := sockets[i].(*net.UnixListener); ok {
+			if err := cliArgs.checkPeerCredentials(spec); err != nil {
+				log.Error().Err(err).Msg("invalid listener configuration")
+				os.Exit(sysexits.Usage)
+			}
+		}
+		listeners[i] = spec.Wrap(sockets[i], tlsConfig, cliArgs.ProxySources)
+		hasAdminListener = hasAdminListener || spec.Role == roleAdmin
 	}
 
 	// Create the handler and perform the initial build.
 	siteHandler := snowweb.NewSnowWebServer(cliArgs.Installable)
 	siteHandler.Profile = cliArgs.Profile
-	log.Info().Msg("performing initial build")
-	if err := siteHandler.Realise(); err != nil {
-		log.Error().Err(err).Str("installable", cliArgs.Installable).Msg("could not build path to serve")
-		os.Exit(sysexits.Unavailable)
+	siteHandler.AutoIndex = cliArgs.AutoIndex
+	siteHandler.DisablePublicAPI = hasAdminListener
+	siteHandler.Version = version()
+	siteHandler.Liveness = cliArgs.healthCriteria(cliArgs.HealthzChecks)
+	siteHandler.Readiness = cliArgs.healthCriteria(cliArgs.ReadyzChecks)
+	if cliArgs.TLS.Enabled() {
+		siteHandler.CertificateExpiry = cliArgs.TLS.CertificateExpiry
 	}
 
-	server := &http.Server{
-		Handler: siteHandler,
-		// Timeout requests to mitigate slowloris attacks, but do not
-		// timeout response writes to avoid failing large downloads on
-		// slow connections.  Remote-triggered rebuilds would also run
-		// foul of a write timeout, because it covers the entirety of
-		// the handler's runtime.
-		IdleTimeout:       5 * time.Minute,
-		ReadHeaderTimeout: 10 * time.Second,
-		ReadTimeout:       10 * time.Second,
+	// Set up authentication, authorization and other settings that can
+	// be changed without restarting the server.
+	reloader := newConfigReloader(siteHandler, clientCAs, parser, cliArgs.TLS.CheckInterval)
+	if err := reloader.Apply(&cliArgs); err != nil {
+		log.Error().Err(err).Msg("could not configure server")
+		if errors.Is(err, fs.ErrNotExist) {
+			os.Exit(sysexits.NoInput)
+		}
+		os.Exit(sysexits.DataErr)
+	}
+	siteHandler.ReloadConfig = reloader.Reload
+	if cliArgs.AuditLog != "" {
+		auditWriter, err := logwriter.JSONWriter(cliArgs.AuditLog)
+		if err != nil {
+			log.Error().Err(err).Str("address", cliArgs.AuditLog).Msg("could not open audit log destination")
+			os.Exit(sysexits.Unavailable)
+		}
+		siteHandler.Audit = snowweb.NewAuditLog(auditWriter)
+
+		// Make past records available through the API, if we can.
+		if network, path, _ := sockaddr.SplitNetworkAddress(cliArgs.AuditLog); network == "file" {
+			if f, err := os.Open(path); err == nil {
+				if err := siteHandler.Audit.Load(f); err != nil {
+					log.Warn().Err(err).Str("path", path).Msg("could not load previous audit records")
+				}
+				f.Close()
+			}
+		}
+	}
+	for prefix, installable := range cliArgs.Mounts {
+		if err := siteHandler.Mount(prefix, installable); err != nil {
+			log.Error().Err(err).Str("mount", prefix).Msg("could not mount installable")
+			os.Exit(sysexits.Usage)
+		}
+	}
+	prefixes := []string{"/"}
+	for prefix := range cliArgs.Mounts {
+		prefixes = append(prefixes, prefix)
+	}
+	notifier := newServiceNotifier(siteHandler, prefixes)
+	switch {
+	case inherited != nil:
+		log.Info().Msg("serving paths of previous server process")
+		for _, prefix := range prefixes {
+			err := errors.New("not served by previous server process")
+			if path, ok := inherited.Paths[prefix]; ok {
+				err = siteHandler.ServePath(prefix, path)
+			}
+			if err != nil {
+				log.Warn().Err(err).Str("mount", prefix).Msg("could not take over mount, building it")
+				if _, err := siteHandler.RealiseMount(prefix, snowweb.RealiseOptions{}); err != nil {
+					log.Error().Err(err).Str("mount", prefix).Msg("could not build path to serve")
+					os.Exit(sysexits.Unavailable)
+				}
+			}
+		}
+
+	case cliArgs.BackgroundBuild:
+		// Serve what was last built until the build finishes, switching
+		// only if it succeeds.
+		for _, prefix := range prefixes {
+			_, err := siteHandler.ServeProfile(prefix)
+			if err != nil && prefix == "/" && cliArgs.FallbackPath != "" {
+				log.Warn().Err(err).Str("path", cliArgs.FallbackPath).Msg("could not serve profile, serving fallback path")
+				err = siteHandler.ServePath(prefix, cliArgs.FallbackPath)
+			}
+			if err != nil {
+				log.Warn().Err(err).Str("mount", prefix).Msg("nothing to serve until the initial build finishes")
+			}
+		}
+		go func() {
+			log.Info().Msg("performing initial build in the background")
+			if err := siteHandler.Realise(); err != nil {
+				log.Error().Err(err).Stringer("installable", cliArgs.Installable).Msg("could not build path to serve")
+			}
+		}()
+
+	default:
+		log.Info().Msg("performing initial build")
+		if err := siteHandler.Realise(); err != nil {
+			log.Error().Err(err).Stringer("installable", cliArgs.Installable).Msg("could not build path to serve")
+			os.Exit(sysexits.Unavailable)
+		}
 	}
 
-	// Spin up the server in a different goroutine.
-	go func() {
-		err := server.Serve(listener)
-		if !errors.Is(err, http.ErrServerClosed) {
-			log.Error().Err(err).Msg("server failed")
+	// Spin up a server for each listener in a different goroutine.
+	servers := make([]*http.Server, len(listeners))
+	for i, listener := range listeners {
+		var handler http.Handler
+		switch specs[i].Role {
+		case roleSite:
+			handler = siteHandler
+			handler = cliArgs.TLS.HSTSHandler(handler)
+		case roleAdmin:
+			handler = siteHandler.AdminHandler()
+		case roleMetrics:
+			handler = siteHandler.MetricsHandler()
+		case roleRedirect:
+			handler = cliArgs.TLS.HTTPChallengeHandler(&snowweb.HTTPSRedirect{Port: httpsPort, Error: siteHandler.Error})
+		}
+		if len(cliArgs.TrustedProxies) > 0 {
+			handler = newForwardedHandler(handler, cliArgs.TrustedProxies)
+		}
+
+		server := &http.Server{
+			Handler:     handler,
+			ConnContext: snowweb.ConnContext,
+			// Timeout requests to mitigate slowloris attacks, but do not
+			// timeout response writes to avoid failing large downloads on
+			// slow connections.  Remote-triggered rebuilds would also run
+			// foul of a write timeout, because it covers the entirety of
+			// the handler's runtime.
+			IdleTimeout:       5 * time.Minute,
+			ReadHeaderTimeout: 10 * time.Second,
+			ReadTimeout:       10 * time.Second,
 		}
-	}()
-	log.Info().Stringer("address", listener.Addr()).Msg("server started")
+		servers[i] = server
 
+		role := specs[i].Role
+		go func(listener net.Listener) {
+			err := server.Serve(listener)
+			// The listening socket is closed before shutting down when
+			// handing over to a new process.
+			if !errors.Is(err, http.ErrServerClosed) && !errors.Is(err, net.ErrClosed) {
+				log.Error().Err(err).Str("role", role).Msg("server failed")
+			}
+		}(listener)
+		log.Info().Stringer("address", listener.Addr()).Str("role", role).Bool("tls", specs[i].UsesTLS(tlsConfig != nil)).Msg("server started")
+	}
 	// Provision TLS certificates after the server is running, so that
 	// ACME challenges can be solved.
 	if cliArgs.TLS.Enabled() {
@@ -140,7 +452,12 @@ func main() {
 			log.Error().Err(err).Msg("could not load TLS certificate")
 			os.Exit(sysexits.NoInput)
 		}
+		go cliArgs.TLS.MonitorCerts(cliArgs.healthCertValidity())
 	}
+	// Only let the server this process is replacing shut down, and
+	// report being ready, once this one can serve in its place.
+	inherited.Ready()
+	notifier.Started()
 
 	// Watch for SIGINT and SIGTERM to shut down the server.
 	interrupt := make(chan os.Signal, 1)
@@ -149,38 +466,133 @@ func main() {
 
 	// Watch for SIGHUP, SIGUSR1 and SIGUSR2 to reload (parts of) the
 	// server.
+	reloadConfig := make(chan os.Signal, 1)
 	reloadRoot := make(chan os.Signal, 1)
 	reloadTLS := make(chan os.Signal, 1)
+	signal.Notify(reloadConfig, unix.SIGHUP)
 	signal.Notify(reloadRoot, unix.SIGHUP)
 	signal.Notify(reloadRoot, unix.SIGUSR1)
 	signal.Notify(reloadTLS, unix.SIGHUP)
 	signal.Notify(reloadTLS, unix.SIGUSR2)
 
+	// Watch for the upgrade signal to hand over to a new process.
+	upgradeServer := make(chan os.Signal, 1)
+	signal.Notify(upgradeServer, sigUpgrade)
+
+	// Keep systemd's watchdog, if any, from considering the server hung,
+	// including while this loop waits for a handover or shutdown.
+	go notifier.RunWatchdog()
+
+	// The new process started by an upgrade, while it's getting ready
+	// to serve; this loop keeps handling signals in the meantime.
+	var pending *handover
+	var upgraded <-chan error
+
 	for {
 		select {
 		case <-interrupt:
+			if pending != nil {
+				log.Info().Msg("stopping new server process")
+				pending.Abort()
+			}
 			log.Info().Msg("shutting down")
-			if err := server.Shutdown(context.Background()); err != nil {
-				log.Error().Err(err).Msg("server did not shut down cleanly")
+			notifier.Stopping()
+			shutdown(siteHandler, servers, specs, cliArgs.DrainDelay, cliArgs.DrainTimeout, cliArgs.ShutdownBuilds)
+			log.Info().Msg("shut down")
+			return
+
+		case <-upgradeServer:
+			if pending != nil {
+				log.Warn().Msg("already handing over to new server process")
+				continue
 			}
+			log.Info().Msg("handing over to new server process")
+			h, err := startUpgrade(cliArgs.UpgradeExecutable, specs, sockets, siteHandler)
+			if err != nil {
+				log.Error().Err(err).Msg("could not hand over to new server process")
+				continue
+			}
+			pending, upgraded = h, h.Done
+
+		case err := <-upgraded:
+			h := pending
+			pending, upgraded = nil, nil
+			if err != nil {
+				log.Error().Err(err).Msg("could not hand over to new server process")
+				continue
+			}
+			h.Complete()
+			log.Info().Msg("shutting down after handing over")
+			for _, socket := range sockets {
+				socket.Close()
+			}
+			time.Sleep(handoverGracePeriod)
+			shutdown(siteHandler, servers, specs, 0, cliArgs.DrainTimeout, cliArgs.ShutdownBuilds)
 			return
 
-		case <-reloadRoot:
-			log.Info().Msg("rebuilding website")
-			if err := siteHandler.Realise(); err != nil {
-				log.Error().Err(err).Str("installable", cliArgs.Installable).Msg("could not build path to serve")
+		case sig := <-reloadConfig:
+			log.Info().Msg("reloading configuration")
+			rec := snowweb.AuditRecord{
+				Action:   snowweb.ActionConfig,
+				Identity: "signal:" + unix.SignalName(sig.(unix.Signal)),
+				Outcome:  snowweb.AuditSuccess,
+			}
+			if _, err := reloader.Reload(); err != nil {
+				log.Error().Err(err).Msg("could not reload configuration")
+				rec.Outcome = snowweb.AuditFailure
+				rec.Error = err.Error()
 			}
+			siteHandler.Audit.Record(rec)
+
+		// Builds and certificate renewals can take a while, so they run
+		// in the background to keep this loop responsive.
+		case sig := <-reloadRoot:
+			log.Info().Msg("rebuilding website")
+			go func() {
+				rec := snowweb.AuditRecord{
+					Action:   snowweb.ActionReload,
+					Identity: "signal:" + unix.SignalName(sig.(unix.Signal)),
+					Outcome:  snowweb.AuditSuccess,
+				}
+				if err := siteHandler.Realise(); err != nil {
+					log.Error().Err(err).Stringer("installable", cliArgs.Installable).Msg("could not build path to serve")
+					rec.Outcome = snowweb.AuditFailure
+					rec.Error = err.Error()
+				}
+				siteHandler.Audit.Record(rec)
+			}()
 
 		case <-reloadTLS:
 			log.Info().Msg("started reloading TLS certificate")
-			if err := cliArgs.TLS.ReloadCerts(); err != nil {
-				log.Error().Err(err).Msg("could not reload TLS certificate")
-			}
-			log.Info().Msg("finished reloading TLS certificate")
+			go func() {
+				if err := cliArgs.TLS.ReloadCerts(); err != nil {
+					log.Error().Err(err).Msg("could not reload TLS certificate")
+				}
+				log.Info().Msg("finished reloading TLS certificate")
+			}()
 		}
 	}
 }
 
+// version returns the version of the program, as recorded by the Go
+// toolchain when building it.
+func version() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return ""
+	}
+	return info.Main.Version
+}
+
+// newServerParser creates the command-line parser for the server's
+// arguments.
+func newServerParser(args *CLI) (*kong.Kong, error) {
+	return kong.New(args,
+		kong.Description("Serve a Nix package as a website.\n\nRun `snowweb ctl --help` and `snowweb config --help` for the client and configuration commands."),
+		TLSVars,
+		kong.PostBuild(defaultEnv{"SNOWWEB_"}.Apply))
+}
+
 // defaultEnv assigns an environment variable to all command-line
 // flags and arguments in the Kong parse tree that do not have one
 // already.
@@ -0,0 +1,162 @@
+// SPDX-FileCopyrightText: 2021 Aluísio Augusto Silva Gonçalves <https://aasg.name>
+//
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"git.sr.ht/~aasg/snowweb"
+	systemd "github.com/coreos/go-systemd/daemon"
+	"github.com/rs/zerolog/log"
+)
+
+// A serviceNotifier reports the state of the server to systemd (see
+// man:sd_notify(3)).  Nothing is reported if the server was not
+// started by systemd as a notify service.
+type serviceNotifier struct {
+	// Handler whose mounts are reported on.
+	handler *snowweb.SnowWebServer
+	// URL path prefixes of the handler's mounts.
+	prefixes []string
+
+	mu sync.Mutex
+	// Whether the server has been reported as ready.
+	ready bool
+	// Whether the server's listeners are serving.
+	started bool
+	// Mounts being built.
+	building map[string]bool
+	// What the last build of each mount resulted in, for the status.
+	results map[string]string
+}
+
+// newServiceNotifier creates a serviceNotifier for a handler with
+// mounts at the given URL path prefixes, and sets it up to be told of
+// the handler's builds.
+func newServiceNotifier(handler *snowweb.SnowWebServer, prefixes []string) *serviceNotifier {
+	n := &serviceNotifier{
+		handler:  handler,
+		prefixes: prefixes,
+		building: make(map[string]bool),
+		results:  make(map[string]string),
+	}
+	handler.OnBuild = n.buildEvent
+	return n
+}
+
+// notify sends state to systemd.
+func (n *serviceNotifier) notify(state string) {
+	if _, err := systemd.SdNotify(false, state); err != nil {
+		log.Warn().Err(err).Msg("could not notify systemd of server state")
+	}
+}
+
+// Started reports that the server's listeners are serving, with their
+// TLS certificates loaded.  The server is reported as ready once all
+// its mounts are served, which may be after their initial build.
+func (n *serviceNotifier) Started() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.started = true
+	n.update()
+}
+
+// Stopping reports that the server is shutting down.
+func (n *serviceNotifier) Stopping() {
+	n.notify("STOPPING=1\nSTATUS=Draining connections and builds")
+}
+
+// buildEvent reports a build of one of the handler's mounts.
+func (n *serviceNotifier) buildEvent(event snowweb.BuildEvent) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if event.DryRun {
+		return
+	}
+	wasBuilding := len(n.building) > 0
+	switch {
+	case event.Started:
+		n.building[event.Mount] = true
+	case event.Err != nil:
+		delete(n.building, event.Mount)
+		n.results[event.Mount] = fmt.Sprintf("build failed: %v", event.Err)
+	default:
+		delete(n.building, event.Mount)
+		delete(n.results, event.Mount)
+	}
+
+	// Rebuilds after the server is ready are reported as reloads.
+	if n.ready && !wasBuilding && len(n.building) > 0 {
+		n.notify("RELOADING=1")
+	}
+	if n.ready && wasBuilding && len(n.building) == 0 {
+		n.notify("READY=1")
+	}
+	n.update()
+}
+
+// update reports the server as ready if it has become so, along with
+// its status.  n.mu must be held.
+func (n *serviceNotifier) update() {
+	if !n.started {
+		return
+	}
+	state := "STATUS=" + n.status()
+	if !n.ready && len(n.handler.ServedPaths()) == len(n.prefixes) {
+		n.ready = true
+		state = "READY=1\n" + state
+	}
+	n.notify(state)
+}
+
+// status describes the state of the server in a single line.  n.mu
+// must be held.
+func (n *serviceNotifier) status() string {
+	var parts []string
+	for _, prefix := range n.prefixes {
+		part := prefix + " not served yet"
+		if path, generation := n.handler.CurrentGeneration(prefix); path != "" {
+			part = fmt.Sprintf("%v at generation %v (%v)", prefix, generation, path)
+		}
+		if n.building[prefix] {
+			part += ", building"
+		} else if result, ok := n.results[prefix]; ok {
+			part += ", last " + result
+		}
+		parts = append(parts, part)
+	}
+	return strings.Join(parts, "; ")
+}
+
+// watchdogTicker returns a ticker to send keep-alive pings to systemd's
+// watchdog at, or nil if the watchdog is disabled.
+func watchdogTicker() *time.Ticker {
+	interval, err := systemd.SdWatchdogEnabled(false)
+	if err != nil {
+		log.Warn().Err(err).Msg("could not read systemd watchdog settings")
+	}
+	if interval == 0 {
+		return nil
+	}
+	// Ping twice per interval, as recommended by systemd.
+	return time.NewTicker(interval / 2)
+}
+
+// RunWatchdog sends keep-alive pings to systemd's watchdog, if it's
+// enabled, for as long as the process runs.  It returns right away if
+// the watchdog is disabled.
+func (n *serviceNotifier) RunWatchdog() {
+	ticker := watchdogTicker()
+	if ticker == nil {
+		return
+	}
+	for range ticker.C {
+		n.notify("WATCHDOG=1")
+	}
+}
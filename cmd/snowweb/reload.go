@@ -0,0 +1,292 @@
+// SPDX-FileCopyrightText: 2021 Aluísio Augusto Silva Gonçalves <https://aasg.name>
+//
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"git.sr.ht/~aasg/snowweb"
+	"git.sr.ht/~aasg/snowweb/internal/certpool"
+	"github.com/alecthomas/kong"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// reloadableFlags lists the flags whose changes are applied when the
+// server's configuration is reloaded.  Changes to other flags only
+// take effect after a restart.
+var reloadableFlags = []string{
+	"debug",
+	"client-ca",
+	"auth-token-file", "auth-hmac-key-file", "auth-policy",
+	"admin-uid", "admin-gid",
+	"trusted-key",
+	"allow-flake-ref", "allow-override-input", "allow-update-input",
+	"rate-limit", "rate-burst", "identity-rate-limit", "identity-rate-burst", "lockout-threshold", "lockout-duration",
+}
+
+// A configReloader applies the settings of the server that can be
+// changed while it's running, and re-reads them on request.
+type configReloader struct {
+	// Handler being configured.
+	handler *snowweb.SnowWebServer
+	// CAs trusted to issue client certificates.
+	clientCAs *clientCAPool
+	// Watcher reloading the client CA bundle when it changes.
+	clientCAWatcher *fileWatcher
+
+	// Authentication and authorization methods of the handler before
+	// it was configured, which other methods are added to.
+	defaultAuthenticators []snowweb.Authenticator
+	defaultAuthorize      func(r *http.Request, id *snowweb.Identity, action string) bool
+
+	mu sync.Mutex
+	// Parsers holding the configuration the server was started with,
+	// and the one last applied.
+	started, applied *kong.Kong
+	// Path to the client CA bundle last applied.
+	clientCAPath string
+}
+
+// newConfigReloader creates a configReloader for the handler, which
+// was set up according to the configuration parsed by parser.  The
+// client CA bundle is checked for changes at least every
+// checkInterval.
+func newConfigReloader(handler *snowweb.SnowWebServer, clientCAs *clientCAPool, parser *kong.Kong, checkInterval time.Duration) *configReloader {
+	c := &configReloader{
+		handler:               handler,
+		clientCAs:             clientCAs,
+		defaultAuthenticators: handler.Authenticators,
+		defaultAuthorize:      handler.AuthorizeRequest,
+		started:               parser,
+		applied:               parser,
+	}
+	c.clientCAWatcher = newFileWatcher(checkInterval, c.reloadClientCAs)
+	return c
+}
+
+// Apply configures the handler with the settings in args that can be
+// changed while the server is running.  Nothing is changed if any of
+// the files referenced by the settings cannot be loaded.
+func (c *configReloader) Apply(args *CLI) error {
+	var clientCAs *x509.CertPool
+	if args.ClientCA != "" {
+		pool, err := certpool.LoadX509CertPool(args.ClientCA)
+		if err != nil {
+			return fmt.Errorf("reading client CA bundle: %w", err)
+		}
+		clientCAs = pool
+		log.Debug().Str("ca_path", args.ClientCA).Msg("enabled client certificate verification")
+	}
+
+	authenticators := append([]snowweb.Authenticator(nil), c.defaultAuthenticators...)
+	if c.handler.DisablePublicAPI {
+		authenticators = append(authenticators, &snowweb.PeerCredentialAuthenticator{
+			UIDs: args.AdminUIDs,
+			GIDs: args.AdminGIDs,
+		})
+	}
+	if len(args.TokenFiles) > 0 {
+		authenticator, err := snowweb.LoadBearerTokens(args.TokenFiles...)
+		if err != nil {
+			return fmt.Errorf("loading API tokens: %w", err)
+		}
+		authenticators = append(authenticators, authenticator)
+	}
+	if len(args.HMACKeyFiles) > 0 {
+		authenticator, err := snowweb.LoadHMACKeys(args.HMACKeyFiles...)
+		if err != nil {
+			return fmt.Errorf("loading API signing keys: %w", err)
+		}
+		authenticators = append(authenticators, authenticator)
+	}
+
+	authorize := c.defaultAuthorize
+	if args.AuthPolicy != "" {
+		policy, err := snowweb.LoadPolicy(args.AuthPolicy)
+		if err != nil {
+			return err
+		}
+		authorize = policy.AuthorizeRequest
+	}
+
+	rateLimiter := &snowweb.RateLimiter{
+		PerAddress:       snowweb.RateLimit{Rate: args.RateLimit, Burst: args.RateBurst},
+		PerIdentity:      snowweb.RateLimit{Rate: args.IdentityRateLimit, Burst: args.IdentityRateBurst},
+		LockoutThreshold: args.LockoutThreshold,
+		LockoutDuration:  args.LockoutDuration,
+	}
+
+	c.handler.Reconfigure(func(h *snowweb.SnowWebServer) {
+		h.Authenticators = authenticators
+		h.AuthorizeRequest = authorize
+		h.TrustedKeys = args.TrustedKeys
+		h.ReloadPolicy = snowweb.ReloadPolicy{
+			FlakeRefs:      args.AllowFlakeRefs,
+			OverrideInputs: args.AllowOverrideInputs,
+			UpdateInputs:   args.AllowUpdateInputs,
+		}
+	})
+	// The rate limiter is set up once, so that it keeps track of
+	// clients across reloads.
+	if c.handler.RateLimiter == nil {
+		c.handler.RateLimiter = rateLimiter
+	} else {
+		c.handler.RateLimiter.Reconfigure(rateLimiter)
+	}
+	c.clientCAs.Store(clientCAs)
+	c.clientCAPath = args.ClientCA
+	if args.ClientCA != "" {
+		c.clientCAWatcher.Watch(args.ClientCA)
+	} else {
+		c.clientCAWatcher.Watch()
+	}
+
+	if args.Debug {
+		zerolog.SetGlobalLevel(zerolog.DebugLevel)
+	} else {
+		zerolog.SetGlobalLevel(zerolog.InfoLevel)
+	}
+	return nil
+}
+
+// reloadClientCAs reloads the client CA bundle after it changes.
+func (c *configReloader) reloadClientCAs() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.clientCAPath == "" {
+		return
+	}
+	log.Info().Str("ca_path", c.clientCAPath).Msg("client CA bundle changed, reloading")
+	c.clientCAWatcher.Watch(c.clientCAPath)
+	pool, err := certpool.LoadX509CertPool(c.clientCAPath)
+	if err != nil {
+		log.Error().Err(err).Str("ca_path", c.clientCAPath).Msg("rejected changed client CA bundle, keeping the current one")
+		return
+	}
+	c.clientCAs.Store(pool)
+}
+
+// Reload re-reads the server's configuration from the command line,
+// environment and configuration file, and applies the settings that
+// can be changed while the server is running.
+//
+// The changed settings are returned, listing separately those that
+// only take effect after a restart.
+func (c *configReloader) Reload() (snowweb.ConfigChanges, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var changes snowweb.ConfigChanges
+	var args CLI
+	parser, err := newServerParser(&args)
+	if err != nil {
+		return changes, err
+	}
+	if _, err := parser.Parse(os.Args[1:]); err != nil {
+		return changes, fmt.Errorf("parsing configuration: %w", err)
+	}
+	if err := c.Apply(&args); err != nil {
+		return changes, err
+	}
+
+	for _, name := range changedFlags(c.applied, parser) {
+		if contains(reloadableFlags, name) {
+			changes.Applied = append(changes.Applied, name)
+		}
+	}
+	for _, name := range changedFlags(c.started, parser) {
+		if !contains(reloadableFlags, name) {
+			changes.RestartRequired = append(changes.RestartRequired, name)
+		}
+	}
+	c.applied = parser
+
+	log.Info().Strs("applied", changes.Applied).Msg("reloaded configuration")
+	if len(changes.RestartRequired) > 0 {
+		log.Warn().Strs("settings", changes.RestartRequired).Msg("some configuration changes require a restart to take effect")
+	}
+	return changes, nil
+}
+
+// changedFlags returns the names of the flags and positional arguments
+// whose values differ between two parses of the server's arguments.
+func changedFlags(old, new *kong.Kong) []string {
+	oldValues := make(map[string]interface{})
+	for _, flag := range old.Model.Flags {
+		oldValues[flag.Name] = flag.Target.Interface()
+	}
+	for _, arg := range old.Model.Positional {
+		oldValues[arg.Name] = arg.Target.Interface()
+	}
+
+	var changed []string
+	check := func(value *kong.Value) {
+		if !reflect.DeepEqual(oldValues[value.Name], value.Target.Interface()) {
+			changed = append(changed, value.Name)
+		}
+	}
+	for _, flag := range new.Model.Flags {
+		check(flag.Value)
+	}
+	for _, arg := range new.Model.Positional {
+		check(arg)
+	}
+	return changed
+}
+
+// A clientCAPool holds the CAs trusted to issue TLS client
+// certificates, which can be replaced while the server is running.
+type clientCAPool struct {
+	// TLS configuration connections are served with, or nil if TLS
+	// is not enabled.
+	base *tls.Config
+	// Current pool of CAs, as an *x509.CertPool.
+	pool atomic.Value
+	// Configuration new connections are served with, as a
+	// *tls.Config, or nil if it's base.
+	config atomic.Value
+}
+
+// Load returns the current pool of CAs, or nil if client certificates
+// are not verified.
+func (p *clientCAPool) Load() *x509.CertPool {
+	pool, _ := p.pool.Load().(*x509.CertPool)
+	return pool
+}
+
+// Store replaces the pool of CAs.  Connections made afterwards are
+// verified against the new pool, while existing ones are unaffected.
+func (p *clientCAPool) Store(pool *x509.CertPool) {
+	var config *tls.Config
+	if p.base != nil && pool != nil {
+		config = p.base.Clone()
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+		config.ClientCAs = pool
+	}
+	p.pool.Store(pool)
+	p.config.Store(config)
+}
+
+// Apply sets up tlsConfig to verify client certificates against the
+// current pool of CAs for each connection.  It must be called before
+// the pool is first stored, and tlsConfig must not be changed
+// afterwards.
+func (p *clientCAPool) Apply(tlsConfig *tls.Config) {
+	p.base = tlsConfig
+	tlsConfig.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		config, _ := p.config.Load().(*tls.Config)
+		return config, nil
+	}
+}
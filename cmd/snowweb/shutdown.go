@@ -0,0 +1,87 @@
+// SPDX-FileCopyrightText: 2021 Aluísio Augusto Silva Gonçalves <https://aasg.name>
+//
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"git.sr.ht/~aasg/snowweb"
+	"github.com/rs/zerolog/log"
+)
+
+// What to do with builds running when the server shuts down.
+const (
+	buildsWait   = "wait"   // Wait for them to finish, until the drain timeout
+	buildsCancel = "cancel" // Stop them right away
+	buildsDetach = "detach" // Leave them running and exit
+)
+
+// shutdownServers stops the servers from accepting connections and
+// waits for the requests they're serving to finish, until ctx is done,
+// after which the remaining connections are closed.
+func shutdownServers(ctx context.Context, servers []*http.Server, specs []listenSpec) {
+	var wg sync.WaitGroup
+	for i, server := range servers {
+		wg.Add(1)
+		go func(server *http.Server, role string) {
+			defer wg.Done()
+			err := server.Shutdown(ctx)
+			if errors.Is(err, context.DeadlineExceeded) {
+				log.Warn().Str("role", role).Msg("drain timeout reached, closing remaining connections")
+				err = server.Close()
+			}
+			if err != nil {
+				log.Error().Err(err).Str("role", role).Msg("server did not shut down cleanly")
+			}
+		}(server, specs[i].Role)
+	}
+	wg.Wait()
+}
+
+// finishBuilds deals with the builds still running on shutdown according
+// to policy, one of the builds* constants.  Builds waited for are
+// canceled once ctx is done; those to be canceled outright already were
+// by shutdown.
+func finishBuilds(ctx context.Context, handler *snowweb.SnowWebServer, policy string) {
+	if policy == buildsDetach {
+		return
+	}
+	if err := handler.WaitBuilds(ctx); err != nil {
+		log.Warn().Msg("drain timeout reached, canceling running builds")
+		handler.CancelBuilds()
+		// Canceled builds stop as soon as Nix is killed.
+		handler.WaitBuilds(context.Background())
+	}
+}
+
+// shutdown drains the server: it's reported as draining for delay, while
+// it keeps accepting connections, then it stops accepting connections
+// and waits for the requests it's serving and its builds to finish, up
+// to timeout, or forever if it's 0.
+func shutdown(handler *snowweb.SnowWebServer, servers []*http.Server, specs []listenSpec, delay, timeout time.Duration, buildPolicy string) {
+	handler.Drain()
+	if delay > 0 {
+		log.Info().Dur("delay", delay).Msg("reporting server as draining before shutting down")
+		time.Sleep(delay)
+	}
+
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	// Requests waiting for builds would otherwise hold up draining
+	// until the timeout.
+	if buildPolicy == buildsCancel {
+		handler.CancelBuilds()
+	}
+	shutdownServers(ctx, servers, specs)
+	finishBuilds(ctx, handler, buildPolicy)
+}
@@ -8,9 +8,14 @@ import (
 	"crypto/tls"
 	"errors"
 	"fmt"
+	"net/http"
 	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
 
-	"git.sr.ht/~aasg/snowweb/internal/certpool"
+	"git.sr.ht/~aasg/snowweb"
 	"git.sr.ht/~aasg/snowweb/internal/logwriter"
 	"github.com/alecthomas/kong"
 	"github.com/caddyserver/certmagic"
@@ -36,13 +41,31 @@ type TLSArgs struct {
 	source int
 	// The CertMagic instance used to manage TLS certificates.
 	magic *certmagic.Config
+	// Port at which ACME HTTP-01 challenges are answered, or 0 if they
+	// are not.
+	httpChallengePort int
+	// Issuer of certificates provisioned through ACME.
+	acmeIssuer *acmeIssuer
+	// Lock held while loading the certificate from the filesystem.
+	fileMu sync.Mutex
+	// The certificate last loaded from the filesystem, as a
+	// *fileCertificate.
+	fileCert atomic.Value
+	// Watchers reloading the certificate and key, and the ACME CA
+	// roots, when their files change.
+	certWatcher, rootsWatcher *fileWatcher
+
+	HSTS                  time.Duration `name:"hsts" help:"Ask browsers to only use HTTPS for this long (HSTS max-age)." placeholder:"DURATION"`
+	HSTSIncludeSubdomains bool          `name:"hsts-include-subdomains" help:"Apply HSTS to subdomains as well."`
+	HSTSPreload           bool          `name:"hsts-preload" help:"Allow the domain to be included in browsers' HSTS preload lists."`
+	CheckInterval         time.Duration `name:"check-interval" default:"1m" help:"How often to check the TLS certificate, key and CA files for changes, in case they can't be watched, and the certificate for expiry." placeholder:"DURATION"`
 
 	// These fields are used when source = certSourceFile.
 	Certificate string `env:"SNOWWEB_TLS_CERTIFICATE" help:"Path to TLS server certificate." placeholder:"PATH" group:"File-based TLS"`
 	Key         string `env:"SNOWWEB_TLS_KEY" help:"Path to TLS server certificate key." placeholder:"PATH" group:"File-based TLS"`
 
 	// These fields are used when source = certSourceAcme.
-	ACME ACMEArgs `embed prefix:"acme-"`
+	ACME ACMEArgs `embed:"" prefix:"acme-"`
 }
 
 // ACMEArgs holds the ACME command-line configuration.
@@ -62,6 +85,10 @@ func (args *TLSArgs) Validate() error {
 	}
 	fileSourceEnabled := args.Certificate != ""
 
+	if args.CheckInterval <= 0 {
+		return errors.New("--check-interval must be positive")
+	}
+
 	acmeSourceEnabled := len(args.ACME.Domains) > 0
 
 	switch {
@@ -85,18 +112,22 @@ func (args *TLSArgs) Init() error {
 	certmagic.DefaultACME.Agreed = true
 	certmagic.DefaultACME.CA = args.ACME.CA
 	certmagic.DefaultACME.Email = args.ACME.Email
-	certmagic.DefaultACME.DisableHTTPChallenge = true
+	certmagic.DefaultACME.DisableHTTPChallenge = args.httpChallengePort == 0
+	certmagic.DefaultACME.AltHTTPPort = args.httpChallengePort
 	certmagic.DefaultACME.Logger = zapLogger
 
+	args.magic = certmagic.NewDefault()
+	args.acmeIssuer = newACMEIssuer(args.magic)
+	args.magic.Issuers = []certmagic.Issuer{args.acmeIssuer}
 	if args.ACME.CARoots != "" {
-		caPool, err := certpool.LoadX509CertPool(args.ACME.CARoots)
-		if err != nil {
+		args.rootsWatcher = newFileWatcher(args.CheckInterval, args.reloadACMERoots)
+		if err := args.loadACMERoots(); err != nil {
 			return fmt.Errorf("loading ACME CA roots: %w", err)
 		}
-		certmagic.DefaultACME.TrustedRoots = caPool
 	}
-
-	args.magic = certmagic.NewDefault()
+	if args.source == certSourceFile {
+		args.certWatcher = newFileWatcher(args.CheckInterval, args.reloadFileCert)
+	}
 
 	switch args.source {
 	case certSourceFile:
@@ -110,10 +141,56 @@ func (args *TLSArgs) Init() error {
 	return nil
 }
 
+// EnableHTTPChallenge enables answering ACME HTTP-01 challenges on a
+// plain HTTP listener at the given port, whose handler must be wrapped
+// by HTTPChallengeHandler.  It must be called before Init.
+func (args *TLSArgs) EnableHTTPChallenge(port int) {
+	args.httpChallengePort = port
+}
+
+// HTTPChallengeHandler wraps an http.Handler to answer ACME HTTP-01
+// challenges, if they are enabled.
+func (args *TLSArgs) HTTPChallengeHandler(h http.Handler) http.Handler {
+	if args.source != certSourceAcme || args.httpChallengePort == 0 {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !args.acmeIssuer.Manager().HandleHTTPChallenge(w, r) {
+			h.ServeHTTP(w, r)
+		}
+	})
+}
+
+// HSTSHandler wraps an http.Handler to send a Strict-Transport-Security
+// header in its responses to requests made through HTTPS, if HSTS is
+// enabled.  Requests relayed by proxies count as made through HTTPS if
+// the proxy reports the client connected to it so.
+func (args *TLSArgs) HSTSHandler(h http.Handler) http.Handler {
+	if args.HSTS <= 0 {
+		return h
+	}
+	header := "max-age=" + strconv.Itoa(int(args.HSTS.Seconds()))
+	if args.HSTSIncludeSubdomains {
+		header += "; includeSubDomains"
+	}
+	if args.HSTSPreload {
+		header += "; preload"
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if snowweb.RequestIsHTTPS(r) {
+			w.Header().Set("Strict-Transport-Security", header)
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
 // Config constructs a tls.Config that loads certificates according
 // to the settings specified by the user.
 func (args *TLSArgs) Config() *tls.Config {
 	tlsConfig := args.magic.TLSConfig()
+	if args.source == certSourceFile {
+		tlsConfig.GetCertificate = args.getFileCertificate
+	}
 	tlsConfig.NextProtos = append([]string{"h2", "http/1.1"}, tlsConfig.NextProtos...)
 	tlsConfig.SessionTicketsDisabled = true
 	return tlsConfig
@@ -122,12 +199,16 @@ func (args *TLSArgs) Config() *tls.Config {
 // ReloadCerts forces reloading of the TLS certificate and key.
 //
 // If the TLS keypair is loaded from the file system, it is re-read
-// from the source files.  If the certificate is provisioned through
+// from the source files, and an OCSP response is stapled to it if the
+// certificate names a responder.  If the certificate is provisioned through
 // ACME, it is renewed if it's close to expiring.
+//
+// The files are also reloaded when they change, as are the ACME CA
+// roots.
 func (args *TLSArgs) ReloadCerts() error {
 	switch args.source {
 	case certSourceFile:
-		return args.magic.CacheUnmanagedCertificatePEMFile(args.Certificate, args.Key, nil)
+		return args.loadFileCert()
 	case certSourceAcme:
 		return args.magic.ManageSync(args.ACME.Domains)
 	default:
@@ -135,6 +216,35 @@ func (args *TLSArgs) ReloadCerts() error {
 	}
 }
 
+// CertificateExpiry returns when the TLS certificate expires, or the
+// zero time if it's not loaded.  If certificates are provisioned
+// through ACME, the one expiring first is considered.
+func (args *TLSArgs) CertificateExpiry() time.Time {
+	switch args.source {
+	case certSourceFile:
+		if cert, ok := args.fileCert.Load().(*fileCertificate); ok {
+			return cert.leaf.NotAfter
+		}
+		return time.Time{}
+	case certSourceAcme:
+		var expiry time.Time
+		for _, domain := range args.ACME.Domains {
+			// Only certificates already in memory are returned, since
+			// on-demand TLS is not enabled.
+			cert, err := args.magic.GetCertificate(&tls.ClientHelloInfo{ServerName: domain})
+			if err != nil || cert.Leaf == nil {
+				return time.Time{}
+			}
+			if expiry.IsZero() || cert.Leaf.NotAfter.Before(expiry) {
+				expiry = cert.Leaf.NotAfter
+			}
+		}
+		return expiry
+	default:
+		return time.Time{}
+	}
+}
+
 // Enabled returns true if TLS support was enabled in the command line.
 func (args *TLSArgs) Enabled() bool {
 	return args.source != certSourceNone
@@ -0,0 +1,272 @@
+// SPDX-FileCopyrightText: 2021 Aluísio Augusto Silva Gonçalves <https://aasg.name>
+//
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"git.sr.ht/~aasg/snowweb"
+	systemd "github.com/coreos/go-systemd/daemon"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/sys/unix"
+)
+
+// sigUpgrade is the signal that makes the server hand over to a new
+// process: SIGRTMIN+1, as numbered by glibc.
+const sigUpgrade = unix.Signal(35)
+
+// upgradeStateEnv is the environment variable through which a server
+// passes its state to the process replacing it.
+const upgradeStateEnv = "SNOWWEB_UPGRADE_STATE"
+
+// upgradeTimeout is how long a server waits for the process replacing
+// it to start serving before giving up on the upgrade.
+const upgradeTimeout = 5 * time.Minute
+
+// handoverGracePeriod is how long a server that handed over to a new
+// process waits after it stops accepting connections before shutting
+// down, so that clients whose connections it accepted last can send
+// their requests; those read after the server starts shutting down are
+// dropped.
+const handoverGracePeriod = time.Second
+
+// An upgradeState is what a server passes to the process replacing it,
+// so that the new process can serve right away.
+type upgradeState struct {
+	// File descriptors of the listening sockets, by address.
+	Listeners map[string]int `json:"listeners"`
+	// Store paths being served, by mount prefix.
+	Paths map[string]string `json:"paths"`
+	// File descriptor of the pipe to write to once the new process is
+	// serving.
+	ReadyFD int `json:"readyFd"`
+}
+
+// inheritedState returns the state passed by the server this process
+// is replacing, or nil if it was not started by an upgrade.
+func inheritedState() (*upgradeState, error) {
+	value, ok := os.LookupEnv(upgradeStateEnv)
+	if !ok {
+		return nil, nil
+	}
+	// Don't pass the state on to processes started by this one.
+	os.Unsetenv(upgradeStateEnv)
+
+	var state upgradeState
+	if err := json.Unmarshal([]byte(value), &state); err != nil {
+		return nil, fmt.Errorf("parsing %v: %w", upgradeStateEnv, err)
+	}
+	return &state, nil
+}
+
+// upgradeEnviron returns the environment to start the process replacing
+// this one with.  systemd's watchdog is only enabled for the process
+// named by WATCHDOG_PID, which can't be set to the new process before
+// it's started, so it's dropped to have the new process ping the
+// watchdog too.
+func upgradeEnviron() []string {
+	environ := os.Environ()
+	if os.Getenv("WATCHDOG_PID") != strconv.Itoa(os.Getpid()) {
+		return environ
+	}
+	var kept []string
+	for _, variable := range environ {
+		if !strings.HasPrefix(variable, "WATCHDOG_PID=") {
+			kept = append(kept, variable)
+		}
+	}
+	return kept
+}
+
+// Listener returns the listening socket at the given address passed by
+// the previous server, or nil if it didn't pass one.
+func (state *upgradeState) Listener(address string) (net.Listener, error) {
+	if state == nil {
+		return nil, nil
+	}
+	fd, ok := state.Listeners[address]
+	if !ok {
+		return nil, nil
+	}
+	delete(state.Listeners, address)
+	f := os.NewFile(uintptr(fd), address)
+	defer f.Close()
+	return net.FileListener(f)
+}
+
+// Ready tells the previous server that this process is serving, and
+// closes the listening sockets it passed that are no longer used.
+func (state *upgradeState) Ready() {
+	if state == nil {
+		return
+	}
+	for _, fd := range state.Listeners {
+		unix.Close(fd)
+	}
+	unix.Write(state.ReadyFD, []byte("\n"))
+	unix.Close(state.ReadyFD)
+}
+
+// A handover is a new server process started to replace this one.
+type handover struct {
+	cmd *exec.Cmd
+	// Read end of the pipe the new process writes to once it's
+	// serving.
+	ready *os.File
+	// Listening sockets passed to the new process.
+	sockets []net.Listener
+	// Receives nil once the new process is serving, or an error if it
+	// exits or takes too long before that.
+	Done chan error
+}
+
+// startUpgrade starts a new server process in place of this one,
+// passing it the listening sockets and the store paths being served.
+// The returned handover reports through its Done channel whether the
+// new process started serving, after which Complete should be called
+// and this process should shut down.
+//
+// The new process runs executable, or the program this one was started
+// as if it's empty, with the same arguments.
+func startUpgrade(executable string, specs []listenSpec, sockets []net.Listener, handler *snowweb.SnowWebServer) (*handover, error) {
+	if executable == "" {
+		executable = os.Args[0]
+	}
+	executable, err := exec.LookPath(executable)
+	if err != nil {
+		return nil, err
+	}
+
+	state := upgradeState{
+		Listeners: make(map[string]int, len(sockets)),
+		Paths:     handler.ServedPaths(),
+	}
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for i, socket := range sockets {
+		filer, ok := socket.(interface{ File() (*os.File, error) })
+		if !ok {
+			return nil, fmt.Errorf("listener %v cannot be passed to another process", specs[i].Address)
+		}
+		f, err := filer.File()
+		if err != nil {
+			return nil, fmt.Errorf("listener %v: %w", specs[i].Address, err)
+		}
+		// Descriptors are numbered after the standard streams.
+		state.Listeners[specs[i].Address] = 3 + len(files)
+		files = append(files, f)
+	}
+	ready, readyWriter, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	state.ReadyFD = 3 + len(files)
+	files = append(files, readyWriter)
+
+	encodedState, err := json.Marshal(state)
+	if err != nil {
+		ready.Close()
+		return nil, err
+	}
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Env = append(upgradeEnviron(), upgradeStateEnv+"="+string(encodedState))
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.ExtraFiles = files
+	err = cmd.Start()
+	restoreNonblocking(sockets)
+	if err != nil {
+		ready.Close()
+		return nil, err
+	}
+	// Only the new process should hold the write end of the pipe, so
+	// that we see it closed if the process exits.
+	readyWriter.Close()
+	log.Info().Str("executable", executable).Int("pid", cmd.Process.Pid).Msg("started new server process")
+
+	h := &handover{cmd: cmd, ready: ready, sockets: sockets, Done: make(chan error, 1)}
+	go h.wait()
+	return h, nil
+}
+
+// restoreNonblocking puts listening sockets back in non-blocking mode
+// after their descriptors were passed to another process, which puts
+// them in blocking mode.  Otherwise accepting connections would block
+// outside of the Go runtime's control, and closing the sockets would
+// hang.
+func restoreNonblocking(sockets []net.Listener) {
+	for _, socket := range sockets {
+		conn, ok := socket.(syscall.Conn)
+		if !ok {
+			continue
+		}
+		raw, err := conn.SyscallConn()
+		if err != nil {
+			continue
+		}
+		raw.Control(func(fd uintptr) {
+			if err := unix.SetNonblock(int(fd), true); err != nil {
+				log.Warn().Err(err).Stringer("address", socket.Addr()).Msg("could not restore non-blocking mode of listening socket")
+			}
+		})
+	}
+}
+
+// wait waits for the new process to start serving, and reports the
+// outcome through h.Done.
+func (h *handover) wait() {
+	defer h.ready.Close()
+	// The new process writes to the pipe once it's serving, while the
+	// pipe is closed without being written to if it exits.
+	h.ready.SetReadDeadline(time.Now().Add(upgradeTimeout))
+	if _, err := h.ready.Read(make([]byte, 1)); err != nil {
+		h.cmd.Process.Kill()
+		h.cmd.Wait()
+		if errors.Is(err, io.EOF) {
+			err = errors.New("new server process exited before serving")
+		} else {
+			err = fmt.Errorf("waiting for new server process: %w", err)
+		}
+		h.Done <- err
+		return
+	}
+	go h.cmd.Wait()
+	h.Done <- nil
+}
+
+// Abort kills the new process if it's not serving yet, making h.Done
+// report an error.
+func (h *handover) Abort() {
+	h.cmd.Process.Kill()
+}
+
+// Complete hands over to the new process once it's serving, making
+// systemd track it as the service's main process.  The listening
+// sockets should be closed afterwards.
+func (h *handover) Complete() {
+	// Keep Unix domain sockets in place for the new process when
+	// closing our listeners.
+	for _, socket := range h.sockets {
+		if unixSocket, ok := socket.(*net.UnixListener); ok {
+			unixSocket.SetUnlinkOnClose(false)
+		}
+	}
+	if _, err := systemd.SdNotify(false, "MAINPID="+strconv.Itoa(h.cmd.Process.Pid)); err != nil {
+		log.Warn().Err(err).Msg("could not tell systemd about new server process")
+	}
+}
@@ -0,0 +1,195 @@
+// SPDX-FileCopyrightText: 2021 Aluísio Augusto Silva Gonçalves <https://aasg.name>
+//
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"golang.org/x/sys/unix"
+)
+
+// watchSettleDelay is how long a fileWatcher waits after being notified
+// of a change before checking its files, so that files written or
+// replaced one after the other are checked together.
+const watchSettleDelay = 200 * time.Millisecond
+
+// inotifyMask selects the directory events that make a fileWatcher
+// check its files.
+const inotifyMask = unix.IN_CLOSE_WRITE | unix.IN_CREATE | unix.IN_DELETE | unix.IN_MOVED_FROM | unix.IN_MOVED_TO | unix.IN_ATTRIB
+
+// A fileStamp identifies a version of a file by its inode, modification
+// time and size.
+type fileStamp struct {
+	inode   uint64
+	modTime time.Time
+	size    int64
+}
+
+// statFiles returns the current versions of the given files.
+func statFiles(paths ...string) ([]fileStamp, error) {
+	stamps := make([]fileStamp, len(paths))
+	for i, path := range paths {
+		stat, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		stamps[i] = fileStamp{modTime: stat.ModTime(), size: stat.Size()}
+		if sys, ok := stat.Sys().(*syscall.Stat_t); ok {
+			stamps[i].inode = sys.Ino
+		}
+	}
+	return stamps, nil
+}
+
+// A fileWatcher calls a function when any of a set of files changes.
+// The directories holding the files are watched with inotify, so that
+// changes are noticed right away, including files being replaced by
+// renaming others over them; the files are also checked periodically,
+// in case inotify is not available or misses a change.
+type fileWatcher struct {
+	// How often the files are checked.
+	interval time.Duration
+	// Function called when the files change.
+	onChange func()
+	// Receives a value when inotify reports a change.
+	notified chan struct{}
+	// Inotify instance, or -1 if inotify is not available.
+	inotifyFD int
+
+	mu sync.Mutex
+	// Files being watched.
+	paths []string
+	// Versions of the files last seen, or nil if they could not be
+	// read.
+	stamps []fileStamp
+	// Directories watched with inotify.
+	dirs map[string]bool
+}
+
+// newFileWatcher creates a fileWatcher that calls onChange when the
+// files given to its Watch method change, checking them at least
+// every interval.
+func newFileWatcher(interval time.Duration, onChange func()) *fileWatcher {
+	w := &fileWatcher{
+		interval: interval,
+		onChange: onChange,
+		notified: make(chan struct{}, 1),
+		dirs:     make(map[string]bool),
+	}
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC)
+	if err != nil {
+		log.Warn().Err(err).Dur("interval", interval).Msg("could not watch files with inotify, checking them periodically instead")
+		w.inotifyFD = -1
+	} else {
+		w.inotifyFD = fd
+		go w.readEvents()
+	}
+	go w.run()
+	return w
+}
+
+// Watch replaces the files being watched.  Their current versions are
+// taken as the ones last loaded, so Watch should be called before the
+// files are read.
+func (w *fileWatcher) Watch(paths ...string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.paths = paths
+	w.stamps, _ = statFiles(paths...)
+	if w.inotifyFD < 0 {
+		return
+	}
+	for _, path := range paths {
+		// If the file is a symbolic link, as are those managed by NixOS
+		// and Kubernetes, the file it points to may be replaced without
+		// the link itself changing.
+		dirs := []string{filepath.Dir(path)}
+		if target, err := filepath.EvalSymlinks(path); err == nil {
+			dirs = append(dirs, filepath.Dir(target))
+		}
+		for _, dir := range dirs {
+			if w.dirs[dir] {
+				continue
+			}
+			if _, err := unix.InotifyAddWatch(w.inotifyFD, dir, inotifyMask); err != nil {
+				log.Warn().Err(err).Str("path", dir).Msg("could not watch directory for changes")
+				continue
+			}
+			w.dirs[dir] = true
+		}
+	}
+}
+
+// readEvents notifies the watcher of the events reported by inotify.
+// Events are not told apart, as the files are compared with the
+// versions last seen anyway.
+func (w *fileWatcher) readEvents() {
+	buf := make([]byte, 64*(unix.SizeofInotifyEvent+unix.NAME_MAX+1))
+	for {
+		if _, err := unix.Read(w.inotifyFD, buf); err != nil {
+			if err == unix.EINTR {
+				continue
+			}
+			log.Warn().Err(err).Msg("stopped watching files with inotify, checking them periodically instead")
+			return
+		}
+		select {
+		case w.notified <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// run checks the files whenever inotify reports a change and at every
+// interval, and calls w.onChange if they changed.  It never returns.
+func (w *fileWatcher) run() {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.notified:
+			time.Sleep(watchSettleDelay)
+			select {
+			case <-w.notified:
+			default:
+			}
+		case <-ticker.C:
+		}
+		if w.changed() {
+			w.onChange()
+		}
+	}
+}
+
+// changed checks whether the files changed since they were last seen,
+// and if so records their current versions.
+func (w *fileWatcher) changed() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if len(w.paths) == 0 {
+		return false
+	}
+	stamps, err := statFiles(w.paths...)
+	if err != nil {
+		// The files may be in the middle of being replaced, so check
+		// again later.
+		log.Debug().Err(err).Msg("could not check files for changes")
+		return false
+	}
+	changed := len(w.stamps) != len(stamps)
+	for i := 0; !changed && i < len(stamps); i++ {
+		changed = stamps[i] != w.stamps[i]
+	}
+	w.stamps = stamps
+	return changed
+}
@@ -10,7 +10,10 @@ import (
 	"io/fs"
 	"net/http"
 	"os"
+	"path"
+	"path/filepath"
 	"strings"
+	"syscall"
 	"time"
 
 	"git.sr.ht/~aasg/snowweb/internal/nix"
@@ -21,29 +24,56 @@ import (
 // A NixStorePathServer is an http.Handler that serves static files
 // from a Nix store path.
 type NixStorePathServer struct {
+	// URL path prefixes under which a listing is served for
+	// directories without an index.html file.
+	AutoIndex []string
 	// Function called to respond to a request in case an error happens
 	// while handling the request.
 	Error ErrorHandler
+	// URL path prefix the server is mounted under, which is stripped
+	// from request paths before looking up files.
+	URLPrefix string
 	// The ETag returned in responses and used during conditional
 	// requests, derived from the resolved root path.
 	etag string
+	// Hash and size of the NAR serialization of the store path.
+	narHash string
+	narSize int64
 	// File system rooted at the actual directory being served.
 	resolvedRoot fs.FS
+	// Path of the actual directory being served, which is either the
+	// store path or a directory under it.
+	root string
 	// Nix store path being served.
 	storePath string
 }
 
 // NewNixStorePathServer constructs a new NixStorePathServer.
-func NewNixStorePathServer(storePath string) (*NixStorePathServer, error) {
-	narHash, err := nix.NarHash(storePath)
+//
+// If subPath is not empty, files are served from that directory
+// under the store path instead of from the store path itself.
+func NewNixStorePathServer(storePath, subPath string) (*NixStorePathServer, error) {
+	root := filepath.Join(storePath, filepath.FromSlash(subPath))
+	stat, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+	if !stat.IsDir() {
+		return nil, &fs.PathError{Op: "open", Path: root, Err: syscall.ENOTDIR}
+	}
+
+	info, err := nix.QueryPathInfo(storePath)
 	if err != nil {
 		return nil, err
 	}
 
 	h := NixStorePathServer{
-		etag:         "\"" + narHash + "\"",
+		etag:         "\"" + info.NarHash + "\"",
+		narHash:      info.NarHash,
+		narSize:      info.NarSize,
 		Error:        HandleError,
-		resolvedRoot: os.DirFS(storePath),
+		resolvedRoot: os.DirFS(root),
+		root:         root,
 		storePath:    storePath,
 	}
 	return &h, nil
@@ -54,10 +84,29 @@ func (h *NixStorePathServer) StorePath() string {
 	return h.storePath
 }
 
+// Root returns the path of the directory being served, which is
+// either the store path or a directory under it.
+func (h *NixStorePathServer) Root() string {
+	return h.root
+}
+
+// NarHash returns the hash of the NAR serialization of the store path
+// being served, in the SRI format used by Nix.
+func (h *NixStorePathServer) NarHash() string {
+	return h.narHash
+}
+
+// NarSize returns the size in bytes of the NAR serialization of the
+// store path being served.
+func (h *NixStorePathServer) NarSize() int64 {
+	return h.narSize
+}
+
 // ServeHTTP responds to HTTP GET and HEAD requests with the
 // corresponding file under the server root.  If the request
 // is for a directory, the index.html file under that directory
-// is served instead.
+// is served instead, or a listing of the directory if there is no
+// such file and AutoIndex is enabled for the request path.
 func (h *NixStorePathServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "GET" && r.Method != "HEAD" {
 		h.Error(ErrorUnsupportedMethod, w, r)
@@ -68,11 +117,11 @@ func (h *NixStorePathServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	//
 	// First, do some preprocessing to ensure that expected paths are
 	// considered valid.
-	requestPath := strings.TrimLeft(r.URL.Path, "/")
+	requestPath := strings.TrimLeft(strings.TrimPrefix(r.URL.Path, h.URLPrefix), "/")
 	if requestPath == "" {
 		requestPath = "index.html"
 	} else if strings.HasSuffix(requestPath, "/") {
-		requestPath += "/index.html"
+		requestPath += "index.html"
 	}
 	log.Debug().Str("url_path", r.URL.Path).Str("file_path", requestPath).Msg("rewritten request path")
 	// If the path is not valid, reject the request.
@@ -87,6 +136,9 @@ func (h *NixStorePathServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	f, requestPath, err := h.openFile(requestPath, true)
 	defer closeOrLog(requestPath, f)
 	switch {
+	case errors.Is(err, fs.ErrNotExist) && h.isListableDirectory(r.URL.Path, requestPath):
+		h.serveDirectoryListing(w, r, path.Dir(requestPath))
+		return
 	case errors.Is(err, fs.ErrNotExist):
 		h.Error(ErrorNotFound, w, r)
 		return
@@ -147,6 +199,16 @@ func (h *NixStorePathServer) openFile(filename string, redirectDirectory bool) (
 	return f.(io.ReadSeekCloser), filename, nil
 }
 
+// isListableDirectory checks whether a missing file is the index.html
+// of an existing directory for which a listing can be served instead.
+func (h *NixStorePathServer) isListableDirectory(urlPath, filename string) bool {
+	if path.Base(filename) != "index.html" || !h.autoIndexEnabled(urlPath) {
+		return false
+	}
+	stat, err := fs.Stat(h.resolvedRoot, path.Dir(filename))
+	return err == nil && stat.IsDir()
+}
+
 // brotliSupported checks whether Brotli compression is supported by
 // the user agent (as announced in the Accept-Encoding header).
 func brotliSupported(r *http.Request) bool {
@@ -5,9 +5,14 @@
 package snowweb
 
 import (
+	"errors"
 	"net/http"
 )
 
+// ErrNoTrustedKeys is returned when a store path must have its
+// signatures verified but no trusted keys were configured.
+var ErrNoTrustedKeys = errors.New("no trusted keys configured to verify signatures")
+
 // Errors passed by SnowWeb to error handlers.
 const (
 	_                      = iota
@@ -15,6 +20,8 @@ const (
 	ErrorInvalidPath       // Invalid request path (e.g. contains "..")
 	ErrorNotFound          // Requested file does not exist
 	ErrorIO                // I/O error opening the requested file
+	ErrorUnavailable       // No website has been built yet
+	ErrorBadRequest        // Malformed API request
 )
 
 // ErrorHandler is the signature of a SnowWeb error handler.
@@ -30,7 +37,7 @@ func HandleError(errorCode int, w http.ResponseWriter, r *http.Request) {
 		w.Header().Add("Allow", "GET, HEAD")
 		w.Header().Add("Content-Length", "0")
 		w.WriteHeader(http.StatusMethodNotAllowed)
-	case ErrorInvalidPath:
+	case ErrorInvalidPath, ErrorBadRequest:
 		w.Header().Add("Content-Length", "0")
 		w.WriteHeader(http.StatusBadRequest)
 	case ErrorNotFound:
@@ -39,5 +46,8 @@ func HandleError(errorCode int, w http.ResponseWriter, r *http.Request) {
 	case ErrorIO:
 		w.Header().Add("Content-Length", "0")
 		w.WriteHeader(http.StatusInternalServerError)
+	case ErrorUnavailable:
+		w.Header().Add("Content-Length", "0")
+		w.WriteHeader(http.StatusServiceUnavailable)
 	}
 }
@@ -41,28 +41,17 @@
 
         nixosModule = { config, lib, pkgs, ... }:
           let
-            inherit (lib) flip mkEnableOption mkIf mkOption types;
-            inherit (aasg-nixexprs.lib) concatMapAttrs updateNew;
-
-            settingsToEnv =
-              let
-                inherit (lib) concatStringsSep isAttrs isList toUpper;
-                inherit (aasg-nixexprs.lib) concatMapAttrs;
-                settingToEnvAttrs = prefix: name: value:
-                  let envName = toUpper "${prefix}_${name}";
-                  in
-                  if isAttrs value then
-                    settingsToEnvAttrs envName value
-                  else if isList value then
-                    { ${envName} = concatStringsSep "," value; }
-                  else if value == null then
-                    { }
-                  else
-                    { ${envName} = toString value; };
-                settingsToEnvAttrs = prefix: settings:
-                  concatMapAttrs (settingToEnvAttrs prefix) settings;
-              in
-                /*settings:*/ settingsToEnvAttrs "snowweb";
+            inherit (lib) flip mkEnableOption mkIf mkOption recursiveUpdate types;
+            inherit (aasg-nixexprs.lib) concatMapAttrs;
+
+            # Write a site's settings as a configuration file, with
+            # defaults suitable for the systemd service.
+            configFile = siteName: siteCfg: pkgs.writeText "snowweb-${siteName}.json" (builtins.toJSON (recursiveUpdate
+              {
+                profile = "/run/snowweb/${siteName}/profile";
+                tls.acme.storage = "/var/lib/snowweb";
+              }
+              siteCfg));
 
             cfg = config.services.snowweb;
           in
@@ -117,17 +106,21 @@
                   requires = [ "network.target" ];
                   after = [ "network.target" ];
                   wantedBy = [ "multi-user.target" ];
-                  environment = updateNew (settingsToEnv siteCfg) {
+                  environment = {
                     NIX_REMOTE = "daemon";
                     XDG_CACHE_HOME = "/tmp";
-                    SNOWWEB_PROFILE = "/run/snowweb/%i/profile";
-                    SNOWWEB_TLS_ACME_STORAGE = "/var/lib/snowweb";
                   };
                   path = [ cfg.nixPackage pkgs.gitMinimal ];
                   serviceConfig = {
-                    Type = "exec";
-                    ExecStart = "${cfg.package}/bin/snowweb \${SNOWWEB_INSTALLABLE}";
+                    Type = "notify";
+                    ExecStart = "${cfg.package}/bin/snowweb --config ${configFile siteName siteCfg}";
                     ExecReload = "${pkgs.coreutils}/bin/kill -HUP $MAINPID";
+                    # Let processes replacing the server on upgrades take over.
+                    NotifyAccess = "all";
+                    # The server is only ready after the initial build,
+                    # which can take a while.
+                    TimeoutStartSec = "15min";
+                    WatchdogSec = "1min";
                     Restart = "on-failure";
 
                     DynamicUser = true;
@@ -0,0 +1,245 @@
+// SPDX-FileCopyrightText: 2021 Aluísio Augusto Silva Gonçalves <https://aasg.name>
+//
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package snowweb
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// forwardedSchemeKey is the context key under which ForwardedHandler
+// stores the scheme reported by reverse proxies.
+type forwardedSchemeKey struct{}
+
+// Families of headers through which reverse proxies report the
+// original request.
+const (
+	HeaderForwarded  = "forwarded"   // Forwarded (RFC 7239)
+	HeaderXForwarded = "x-forwarded" // X-Forwarded-For, X-Forwarded-Proto and X-Forwarded-Host
+)
+
+// A TrustedProxy describes reverse proxies trusted to report the
+// original request, and how they report it.
+type TrustedProxy struct {
+	// Network of the proxies, or nil for clients connecting through
+	// Unix domain sockets.
+	Network *net.IPNet
+	// Family of headers the proxies set, one of the Header* constants.
+	// Headers of the other family are passed through by most proxies
+	// as sent by their clients, so they are ignored.
+	Headers string
+}
+
+// A ForwardedHandler wraps an http.Handler to take the client address,
+// scheme and host of requests relayed by trusted reverse proxies from
+// the headers they set.
+//
+// The headers are only honoured if the request comes from a trusted
+// proxy, and only those of the family it's configured with.  When the
+// request has passed through a chain of proxies, the addresses they
+// report are followed from the nearest to the farthest for as long as
+// they belong to proxies trusted with the same family of headers.  The
+// request's RemoteAddr and Host are then replaced by the values the
+// proxies reported, and the scheme is recorded for RequestIsHTTPS, so
+// that logs, rate limiting, authorization and redirects see the
+// original request.
+type ForwardedHandler struct {
+	Handler http.Handler
+	// Proxies trusted to set the headers.
+	Proxies []TrustedProxy
+}
+
+// A forwardedHop holds what a proxy reported about the request it
+// received.
+type forwardedHop struct {
+	// Address of the proxy's client, possibly with a port.
+	For string
+	// Scheme and host the request was made with.
+	Proto, Host string
+}
+
+func (h *ForwardedHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	headers := h.trustedHeaders(requestIP(r))
+	var hops []forwardedHop
+	switch headers {
+	case HeaderForwarded:
+		hops = parseForwarded(r.Header.Values("Forwarded"))
+	case HeaderXForwarded:
+		hops = parseXForwarded(r.Header)
+	}
+	if len(hops) == 0 {
+		h.Handler.ServeHTTP(w, r)
+		return
+	}
+
+	r2 := new(http.Request)
+	*r2 = *r
+	scheme := ""
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := hops[i]
+		switch proto := strings.ToLower(hop.Proto); proto {
+		case "http", "https":
+			scheme = proto
+		}
+		if hop.Host != "" && !strings.ContainsAny(hop.Host, " /") {
+			r2.Host = hop.Host
+		}
+
+		addr, ip := parseForwardedNode(hop.For)
+		if ip == "" {
+			// The proxy doesn't know or won't tell the address of its
+			// client, so there's nothing to follow.
+			break
+		}
+		r2.RemoteAddr = addr
+		if h.trustedHeaders(ip) != headers {
+			break
+		}
+	}
+	if scheme != "" {
+		r2 = r2.WithContext(context.WithValue(r2.Context(), forwardedSchemeKey{}, scheme))
+	}
+	h.Handler.ServeHTTP(w, r2)
+}
+
+// trustedHeaders returns the family of headers a client is trusted to
+// report the original request in, given its IP address, which is
+// empty for clients connecting through Unix domain sockets.  An empty
+// string is returned if the client is not a trusted proxy.
+func (h *ForwardedHandler) trustedHeaders(addr string) string {
+	ip := net.ParseIP(addr)
+	for _, proxy := range h.Proxies {
+		switch {
+		case proxy.Network == nil && addr == "":
+			return proxy.Headers
+		case proxy.Network != nil && ip != nil && proxy.Network.Contains(ip):
+			return proxy.Headers
+		}
+	}
+	return ""
+}
+
+// parseForwarded parses the values of the Forwarded header into the
+// hops it describes, from the farthest to the nearest.
+func parseForwarded(values []string) []forwardedHop {
+	var hops []forwardedHop
+	for _, value := range values {
+		for _, element := range splitQuoted(value, ',') {
+			var hop forwardedHop
+			for _, pair := range splitQuoted(element, ';') {
+				i := strings.IndexByte(pair, '=')
+				if i < 0 {
+					continue
+				}
+				key := strings.ToLower(strings.TrimSpace(pair[:i]))
+				value := strings.Trim(strings.TrimSpace(pair[i+1:]), `"`)
+				switch key {
+				case "for":
+					hop.For = value
+				case "proto":
+					hop.Proto = value
+				case "host":
+					hop.Host = value
+				}
+			}
+			hops = append(hops, hop)
+		}
+	}
+	return hops
+}
+
+// parseXForwarded parses the X-Forwarded-For, X-Forwarded-Proto and
+// X-Forwarded-Host headers into the hops they describe, from the
+// farthest to the nearest.  The scheme and host are taken to be those
+// reported by the nearest proxy.
+func parseXForwarded(header http.Header) []forwardedHop {
+	var hops []forwardedHop
+	for _, value := range header.Values("X-Forwarded-For") {
+		for _, addr := range strings.Split(value, ",") {
+			hops = append(hops, forwardedHop{For: strings.TrimSpace(addr)})
+		}
+	}
+	proto := lastListValue(header.Values("X-Forwarded-Proto"))
+	host := lastListValue(header.Values("X-Forwarded-Host"))
+	if len(hops) == 0 {
+		if proto == "" && host == "" {
+			return nil
+		}
+		hops = []forwardedHop{{}}
+	}
+	last := &hops[len(hops)-1]
+	last.Proto, last.Host = proto, host
+	return hops
+}
+
+// parseForwardedNode parses a node identifier from the Forwarded or
+// X-Forwarded-For headers, returning it in the format of
+// http.Request.RemoteAddr and the bare IP address.  Both are empty if
+// the node is not identified by an IP address, and the port is left
+// out if it's not known.
+func parseForwardedNode(node string) (addr, ip string) {
+	host, port, err := net.SplitHostPort(node)
+	if err != nil {
+		host, port = strings.Trim(node, "[]"), ""
+	}
+	parsed := net.ParseIP(host)
+	if parsed == nil {
+		return "", ""
+	}
+	ip = parsed.String()
+	// Obfuscated ports, which start with an underscore, are left out.
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return ip, ip
+	}
+	return net.JoinHostPort(ip, port), ip
+}
+
+// splitQuoted splits s at each sep outside of double-quoted strings.
+func splitQuoted(s string, sep byte) []string {
+	var parts []string
+	quoted, start := false, 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '"':
+			quoted = !quoted
+		case '\\':
+			if quoted {
+				i++
+			}
+		case sep:
+			if !quoted {
+				parts = append(parts, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// lastListValue returns the last item of a comma-separated header
+// which may be repeated.
+func lastListValue(values []string) string {
+	if len(values) == 0 {
+		return ""
+	}
+	items := strings.Split(values[len(values)-1], ",")
+	return strings.TrimSpace(items[len(items)-1])
+}
+
+// RequestIsHTTPS checks whether the client made a request through
+// HTTPS, either directly, to a proxy that relayed it through the PROXY
+// protocol, or to a trusted reverse proxy, as reported to
+// ForwardedHandler.
+func RequestIsHTTPS(r *http.Request) bool {
+	// The scheme in the request's URL is set by the client, if it
+	// sends an absolute URL, so it's not trusted.
+	if scheme, ok := r.Context().Value(forwardedSchemeKey{}).(string); ok {
+		return scheme == "https"
+	}
+	return r.TLS != nil || RequestProxiedTLS(r) != nil
+}
@@ -0,0 +1,256 @@
+// SPDX-FileCopyrightText: 2021 Aluísio Augusto Silva Gonçalves <https://aasg.name>
+//
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package snowweb
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestForwardedHandler(t *testing.T) {
+	mustParseCIDR := func(s string) *net.IPNet {
+		_, network, err := net.ParseCIDR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return network
+	}
+	proxies := []TrustedProxy{
+		{Network: mustParseCIDR("10.0.0.0/8"), Headers: HeaderForwarded},
+		{Network: mustParseCIDR("192.168.0.0/16"), Headers: HeaderXForwarded},
+		{Network: mustParseCIDR("2001:db8:ffff::/48"), Headers: HeaderForwarded},
+		{Network: nil, Headers: HeaderXForwarded},
+	}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		url        string
+		header     http.Header
+		wantAddr   string
+		wantHost   string
+		wantHTTPS  bool
+	}{
+		{
+			name:       "no headers",
+			remoteAddr: "10.0.0.1:1234",
+			wantAddr:   "10.0.0.1:1234",
+			wantHost:   "site.example",
+		},
+		{
+			name:       "spoofed headers from untrusted peer",
+			remoteAddr: "203.0.113.5:1234",
+			header: http.Header{
+				"Forwarded":         {"for=198.51.100.7;proto=https;host=evil.example"},
+				"X-Forwarded-For":   {"198.51.100.7"},
+				"X-Forwarded-Proto": {"https"},
+				"X-Forwarded-Host":  {"evil.example"},
+			},
+			wantAddr: "203.0.113.5:1234",
+			wantHost: "site.example",
+		},
+		{
+			name:       "Forwarded from trusted peer",
+			remoteAddr: "10.0.0.1:1234",
+			header:     http.Header{"Forwarded": {"for=198.51.100.7;proto=https;host=www.example"}},
+			wantAddr:   "198.51.100.7",
+			wantHost:   "www.example",
+			wantHTTPS:  true,
+		},
+		{
+			name:       "Forwarded chain of trusted proxies",
+			remoteAddr: "10.0.0.1:1234",
+			header:     http.Header{"Forwarded": {"for=198.51.100.7;proto=https", "for=10.0.0.2;proto=http"}},
+			wantAddr:   "198.51.100.7",
+			wantHost:   "site.example",
+			wantHTTPS:  true,
+		},
+		{
+			name:       "Forwarded chain with untrusted hop in the middle",
+			remoteAddr: "10.0.0.1:1234",
+			header:     http.Header{"Forwarded": {"for=198.51.100.7;proto=https;host=evil.example, for=203.0.113.9, for=10.0.0.2;host=www.example"}},
+			wantAddr:   "203.0.113.9",
+			wantHost:   "www.example",
+		},
+		{
+			name:       "X-Forwarded-For chain with untrusted hop in the middle",
+			remoteAddr: "192.168.0.1:1234",
+			header: http.Header{
+				"X-Forwarded-For":   {"198.51.100.7, 203.0.113.9", "192.168.0.2"},
+				"X-Forwarded-Proto": {"https"},
+			},
+			wantAddr:  "203.0.113.9",
+			wantHost:  "site.example",
+			wantHTTPS: true,
+		},
+		{
+			name:       "X-Forwarded-For chain of trusted proxies",
+			remoteAddr: "192.168.0.1:1234",
+			header: http.Header{
+				"X-Forwarded-For":  {"198.51.100.7, 192.168.0.2"},
+				"X-Forwarded-Host": {"evil.example, www.example"},
+			},
+			wantAddr: "198.51.100.7",
+			wantHost: "www.example",
+		},
+		{
+			name:       "X-Forwarded-* from proxy trusted with Forwarded",
+			remoteAddr: "10.0.0.1:1234",
+			header: http.Header{
+				"X-Forwarded-For":   {"198.51.100.7"},
+				"X-Forwarded-Proto": {"https"},
+				"X-Forwarded-Host":  {"evil.example"},
+			},
+			wantAddr: "10.0.0.1:1234",
+			wantHost: "site.example",
+		},
+		{
+			name:       "Forwarded from proxy trusted with X-Forwarded-*",
+			remoteAddr: "192.168.0.1:1234",
+			header: http.Header{
+				"Forwarded":       {"for=198.51.100.7;proto=https;host=evil.example"},
+				"X-Forwarded-For": {"203.0.113.9"},
+			},
+			wantAddr: "203.0.113.9",
+			wantHost: "site.example",
+		},
+		{
+			name:       "chain switching header family",
+			remoteAddr: "10.0.0.1:1234",
+			header: http.Header{
+				"Forwarded":       {"for=203.0.113.9, for=192.168.0.1"},
+				"X-Forwarded-For": {"198.51.100.7"},
+			},
+			wantAddr: "192.168.0.1",
+			wantHost: "site.example",
+		},
+		{
+			name:       "unknown client",
+			remoteAddr: "10.0.0.1:1234",
+			header:     http.Header{"Forwarded": {"for=unknown;proto=https"}},
+			wantAddr:   "10.0.0.1:1234",
+			wantHost:   "site.example",
+			wantHTTPS:  true,
+		},
+		{
+			name:       "obfuscated client",
+			remoteAddr: "10.0.0.1:1234",
+			header:     http.Header{"Forwarded": {`for="_hidden";host=www.example`}},
+			wantAddr:   "10.0.0.1:1234",
+			wantHost:   "www.example",
+		},
+		{
+			name:       "unknown client behind trusted proxy",
+			remoteAddr: "10.0.0.1:1234",
+			header:     http.Header{"Forwarded": {"for=unknown, for=10.0.0.2"}},
+			wantAddr:   "10.0.0.2",
+			wantHost:   "site.example",
+		},
+		{
+			name:       "obfuscated port",
+			remoteAddr: "10.0.0.1:1234",
+			header:     http.Header{"Forwarded": {`for="198.51.100.7:_port"`}},
+			wantAddr:   "198.51.100.7",
+			wantHost:   "site.example",
+		},
+		{
+			name:       "quoted IPv6 address with port",
+			remoteAddr: "[2001:db8:ffff::1]:1234",
+			header:     http.Header{"Forwarded": {`For="[2001:DB8:CAFE::17]:4711";Proto=HTTPS`}},
+			wantAddr:   "[2001:db8:cafe::17]:4711",
+			wantHost:   "site.example",
+			wantHTTPS:  true,
+		},
+		{
+			name:       "quoted IPv6 address without port",
+			remoteAddr: "10.0.0.1:1234",
+			header:     http.Header{"Forwarded": {`for="[2001:db8:cafe::17]"`}},
+			wantAddr:   "2001:db8:cafe::17",
+			wantHost:   "site.example",
+		},
+		{
+			name:       "quoted separators",
+			remoteAddr: "10.0.0.1:1234",
+			header:     http.Header{"Forwarded": {`for=198.51.100.7;host="www.example;a,b", for=10.0.0.2`}},
+			wantAddr:   "198.51.100.7",
+			wantHost:   "www.example;a,b",
+		},
+		{
+			name:       "invalid host",
+			remoteAddr: "10.0.0.1:1234",
+			header:     http.Header{"Forwarded": {`for=198.51.100.7;host="www.example/evil"`}},
+			wantAddr:   "198.51.100.7",
+			wantHost:   "site.example",
+		},
+		{
+			name:       "Unix domain socket peer",
+			remoteAddr: "@",
+			header: http.Header{
+				"X-Forwarded-For":   {"198.51.100.7"},
+				"X-Forwarded-Proto": {"https"},
+			},
+			wantAddr:  "198.51.100.7",
+			wantHost:  "site.example",
+			wantHTTPS: true,
+		},
+		{
+			name:       "scheme without client address",
+			remoteAddr: "@",
+			header:     http.Header{"X-Forwarded-Proto": {"https"}},
+			wantAddr:   "@",
+			wantHost:   "site.example",
+			wantHTTPS:  true,
+		},
+		{
+			name:       "absolute URL from untrusted peer",
+			remoteAddr: "203.0.113.5:1234",
+			url:        "https://site.example/",
+			wantAddr:   "203.0.113.5:1234",
+			wantHost:   "site.example",
+		},
+		{
+			name:       "absolute URL overridden by trusted proxy",
+			remoteAddr: "10.0.0.1:1234",
+			url:        "https://site.example/",
+			header:     http.Header{"Forwarded": {"for=198.51.100.7;proto=http"}},
+			wantAddr:   "198.51.100.7",
+			wantHost:   "site.example",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got *http.Request
+			h := &ForwardedHandler{
+				Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { got = r }),
+				Proxies: proxies,
+			}
+			url := tt.url
+			if url == "" {
+				url = "http://site.example/"
+			}
+			r := httptest.NewRequest("GET", url, nil)
+			r.RemoteAddr = tt.remoteAddr
+			// Only the proxies' connections to the server are tested,
+			// which are not made through TLS.
+			r.TLS = nil
+			for key, values := range tt.header {
+				r.Header[key] = values
+			}
+			h.ServeHTTP(httptest.NewRecorder(), r)
+
+			if got.RemoteAddr != tt.wantAddr {
+				t.Errorf("got RemoteAddr %q, want %q", got.RemoteAddr, tt.wantAddr)
+			}
+			if got.Host != tt.wantHost {
+				t.Errorf("got Host %q, want %q", got.Host, tt.wantHost)
+			}
+			if https := RequestIsHTTPS(got); https != tt.wantHTTPS {
+				t.Errorf("got RequestIsHTTPS %v, want %v", https, tt.wantHTTPS)
+			}
+		})
+	}
+}
@@ -0,0 +1,347 @@
+// SPDX-FileCopyrightText: 2021 Aluísio Augusto Silva Gonçalves <https://aasg.name>
+//
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package snowweb
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"git.sr.ht/~aasg/snowweb/internal/nix"
+	"github.com/rs/zerolog/log"
+)
+
+// ErrNoGeneration is returned when rolling back a mount to a generation
+// that it does not have.
+var ErrNoGeneration = errors.New("no such generation")
+
+// maxGenerations is the number of generations remembered by each mount.
+const maxGenerations = 32
+
+// maxBuildLogSize is the number of bytes of the output of Nix kept for
+// each mount.
+const maxBuildLogSize = 256 << 10
+
+// A generation is a store path that was served by a mount.
+type generation struct {
+	// Sequence number of the generation, starting from 1.
+	Number int `json:"number"`
+	// Store path served.
+	Path string `json:"path"`
+	// Directory within the store path that was served.
+	Root string `json:"root"`
+	// When the mount switched to the store path for the first time.
+	Time time.Time `json:"time"`
+	// Revision and time of last change of the flake the store path was
+	// built from, if known.
+	Revision     string     `json:"revision,omitempty"`
+	LastModified *time.Time `json:"lastModified,omitempty"`
+}
+
+// addGeneration records a new generation for the store path served by
+// fileServer, returning its number.  m.mu must be held for writing.
+func (m *mount) addGeneration(fileServer *NixStorePathServer) int {
+	number := 1
+	if n := len(m.generations); n > 0 {
+		number = m.generations[n-1].Number + 1
+	}
+	m.generations = append(m.generations, generation{
+		Number: number,
+		Path:   fileServer.StorePath(),
+		Root:   fileServer.Root(),
+		Time:   time.Now(),
+	})
+	if len(m.generations) > maxGenerations {
+		m.generations = m.generations[len(m.generations)-maxGenerations:]
+	}
+	return number
+}
+
+// setFlake records the flake the current generation was built from.
+func (m *mount) setFlake(flake *nix.FlakeMetadata) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := range m.generations {
+		g := &m.generations[i]
+		if g.Number != m.currentGeneration {
+			continue
+		}
+		g.Revision = flake.Revision
+		if flake.LastModified != 0 {
+			lastModified := time.Unix(flake.LastModified, 0).UTC()
+			g.LastModified = &lastModified
+		}
+	}
+}
+
+// Generations returns the generations remembered by the mount, oldest
+// first, and the number of the one being served.
+func (m *mount) Generations() ([]generation, int) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return append([]generation(nil), m.generations...), m.currentGeneration
+}
+
+// Rollback switches the mount back to serving a previous generation,
+// which is returned.  If number is 0, the generation before the current
+// one is used.
+//
+// The mount's profile, if any, is updated to point to the generation's
+// store path, and if the mount is pinned to a store path, later
+// rebuilds keep serving the generation's.
+func (m *mount) Rollback(number int) (generation, error) {
+	if err := m.server.startBuild(); err != nil {
+		return generation{}, fmt.Errorf("snowweb: rolling back mount %v: %w", m.prefix, err)
+	}
+	defer m.server.finishBuild()
+	m.buildMu.Lock()
+	defer m.buildMu.Unlock()
+
+	generations, current := m.Generations()
+	target := -1
+	for i, g := range generations {
+		if (number != 0 && g.Number == number) || (number == 0 && g.Number == current) {
+			target = i
+		}
+	}
+	if number == 0 {
+		target--
+	}
+	if target < 0 {
+		if number == 0 {
+			return generation{}, fmt.Errorf("snowweb: no generation before %v for mount %v: %w", current, m.prefix, ErrNoGeneration)
+		}
+		return generation{}, fmt.Errorf("snowweb: generation %v for mount %v: %w", number, m.prefix, ErrNoGeneration)
+	}
+	g := generations[target]
+
+	if profile := m.profile(); profile != "" {
+		buildLog := newLogBuffer(maxBuildLogSize)
+		m.mu.Lock()
+		m.buildLog = buildLog
+		m.mu.Unlock()
+
+		if err := nix.Substitute(m.server.buildCtx, g.Path, profile, buildLog); err != nil {
+			return g, fmt.Errorf("snowweb: updating profile %v: %w", profile, err)
+		}
+	}
+	if err := m.serve(g.Path, g.Number); err != nil {
+		return g, err
+	}
+	m.pinStorePath(g.Path)
+	log.Info().Str("mount", m.prefix).Int("generation", g.Number).Msg("rolled back mount")
+	return g, nil
+}
+
+// BuildLog returns the output of Nix for the running or last build of
+// the mount.
+func (m *mount) BuildLog() []byte {
+	m.mu.RLock()
+	buildLog := m.buildLog
+	m.mu.RUnlock()
+
+	if buildLog == nil {
+		return nil
+	}
+	return buildLog.Bytes()
+}
+
+// A logBuffer is an io.Writer that keeps the last bytes written to it,
+// up to a maximum size.  It is safe for concurrent use.
+type logBuffer struct {
+	mu   sync.Mutex
+	data []byte
+	size int
+}
+
+// newLogBuffer creates a logBuffer that keeps at most size bytes.
+func newLogBuffer(size int) *logBuffer {
+	return &logBuffer{size: size}
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.data = append(b.data, p...)
+	if excess := len(b.data) - b.size; excess > 0 {
+		b.data = append(b.data[:0:0], b.data[excess:]...)
+	}
+	return len(p), nil
+}
+
+// Bytes returns a copy of the data kept in the buffer.
+func (b *logBuffer) Bytes() []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]byte(nil), b.data...)
+}
+
+// serveGenerations responds to a request to the /.snowweb/generations
+// endpoint.
+func (h *SnowWebServer) serveGenerations(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Cache-Control", "no-store")
+	w.Header().Add("Vary", "Accept")
+
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Add("Allow", "GET, HEAD")
+		w.Header().Add("Content-Length", "0")
+		w.WriteHeader(http.StatusNotAcceptable)
+		return
+	}
+	if _, ok := h.authorize(w, r, ActionStatus); !ok {
+		return
+	}
+
+	m := h.findMount(requestMount(r, ""))
+	if m == nil {
+		h.Error(ErrorNotFound, w, r)
+		return
+	}
+
+	generations, current := m.Generations()
+	response := struct {
+		Mount       string       `json:"mount"`
+		Current     int          `json:"current"`
+		Generations []generation `json:"generations"`
+	}{Mount: m.prefix, Current: current, Generations: generations}
+	writeAPIResponse(w, r, response, func(w io.Writer) {
+		for _, g := range generations {
+			marker := " "
+			if g.Number == current {
+				marker = "*"
+			}
+			fmt.Fprintf(w, "%v %v\t%v\t%v\n", marker, g.Number, g.Time.Format(time.RFC3339), g.Path)
+		}
+	})
+}
+
+// A rollbackRequest holds the parameters accepted by the rollback
+// endpoint.
+type rollbackRequest struct {
+	// URL path prefix of the mount to roll back.  It can also be passed
+	// in the query string, and defaults to the root mount.
+	Mount string `json:"mount"`
+	// Number of the generation to switch to, or 0 for the one before
+	// the current generation.
+	Generation int `json:"generation"`
+}
+
+// serveRollback responds to a request to the /.snowweb/rollback
+// endpoint.
+func (h *SnowWebServer) serveRollback(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Cache-Control", "no-store")
+	w.Header().Add("Vary", "Accept")
+
+	if r.Method != "POST" {
+		w.Header().Add("Allow", "POST")
+		w.Header().Add("Content-Length", "0")
+		w.WriteHeader(http.StatusNotAcceptable)
+		return
+	}
+
+	log.Info().Str("address", r.RemoteAddr).Msg("processing remote rollback request")
+	id, ok := h.authorize(w, r, ActionRollback)
+	if !ok {
+		h.audit(r, id, ActionRollback, requestMount(r, ""), nil, "", AuditDenied, nil)
+		return
+	}
+
+	var req rollbackRequest
+	form, err := decodeRequestBody(r, &req)
+	if err == nil && form != nil {
+		req.Mount = form.Get("mount")
+		if number := form.Get("generation"); number != "" {
+			req.Generation, err = strconv.Atoi(number)
+		}
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("could not parse remote rollback request")
+		h.audit(r, id, ActionRollback, requestMount(r, ""), nil, "", AuditRejected, err)
+		h.Error(ErrorBadRequest, w, r)
+		return
+	}
+	req.Mount = requestMount(r, req.Mount)
+	m := h.findMount(req.Mount)
+	if m == nil {
+		h.audit(r, id, ActionRollback, req.Mount, req, "", AuditRejected, fmt.Errorf("snowweb: no installable is mounted at %q", req.Mount))
+		h.Error(ErrorNotFound, w, r)
+		return
+	}
+
+	g, err := m.Rollback(req.Generation)
+	switch {
+	case errors.Is(err, ErrNoGeneration):
+		log.Error().Err(err).Msg("rejected remote rollback request")
+		h.audit(r, id, ActionRollback, req.Mount, req, "", AuditRejected, err)
+		h.Error(ErrorNotFound, w, r)
+		return
+	case err != nil:
+		log.Error().Err(err).Str("mount", req.Mount).Msg("could not roll back website")
+		h.audit(r, id, ActionRollback, req.Mount, req, g.Path, AuditFailure, err)
+	default:
+		h.audit(r, id, ActionRollback, req.Mount, req, g.Path, AuditSuccess, nil)
+	}
+
+	response := struct {
+		OK         bool   `json:"ok"`
+		Mount      string `json:"mount"`
+		Generation int    `json:"generation"`
+		Path       string `json:"path,omitempty"`
+		Root       string `json:"root,omitempty"`
+		Error      string `json:"error,omitempty"`
+	}{OK: err == nil, Mount: req.Mount, Generation: g.Number}
+	if err != nil {
+		response.Error = err.Error()
+	} else {
+		status := m.status()
+		response.Path = status.Path
+		response.Root = status.Root
+	}
+	writeAPIResponse(w, r, response, func(w io.Writer) {
+		if response.OK {
+			fmt.Fprintf(w, "ok\nserving %v\n", response.Root)
+		} else {
+			fmt.Fprintf(w, "error\n%v\n", response.Error)
+		}
+	})
+}
+
+// serveLogs responds to a request to the /.snowweb/logs endpoint.
+func (h *SnowWebServer) serveLogs(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Cache-Control", "no-store")
+	w.Header().Add("Vary", "Accept")
+
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Add("Allow", "GET, HEAD")
+		w.Header().Add("Content-Length", "0")
+		w.WriteHeader(http.StatusNotAcceptable)
+		return
+	}
+	// Build logs may reveal more about the site than its status, so
+	// only those who can trigger builds may read them.
+	if _, ok := h.authorize(w, r, ActionReload); !ok {
+		return
+	}
+
+	m := h.findMount(requestMount(r, ""))
+	if m == nil {
+		h.Error(ErrorNotFound, w, r)
+		return
+	}
+
+	buildLog := m.BuildLog()
+	response := struct {
+		Mount string `json:"mount"`
+		Log   string `json:"log"`
+	}{Mount: m.prefix, Log: string(buildLog)}
+	writeAPIResponse(w, r, response, func(w io.Writer) {
+		w.Write(buildLog)
+	})
+}
@@ -0,0 +1,159 @@
+// SPDX-FileCopyrightText: 2021 Aluísio Augusto Silva Gonçalves <https://aasg.name>
+//
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package snowweb
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// HealthCriteria define what a health endpoint checks for the server
+// to be reported as healthy.
+type HealthCriteria struct {
+	// Whether every mount must be serving a generation.
+	Generation bool
+	// Whether the last build of every mount must have succeeded.
+	// Failures are tolerated for BuildGracePeriod after the first one
+	// since the last successful build.
+	Build            bool
+	BuildGracePeriod time.Duration
+	// Whether the TLS certificate must remain valid for at least
+	// CertificateValidity.
+	Certificate         bool
+	CertificateValidity time.Duration
+	// Whether the server must not be draining.
+	Draining bool
+}
+
+// A healthCheck is the result of checking one of the health criteria.
+type healthCheck struct {
+	Name    string `json:"name"`
+	OK      bool   `json:"ok"`
+	Message string `json:"message,omitempty"`
+}
+
+// checkHealth checks the server against the given criteria.
+func (h *SnowWebServer) checkHealth(criteria HealthCriteria) []healthCheck {
+	now := time.Now()
+	var checks []healthCheck
+
+	if criteria.Generation {
+		check := healthCheck{Name: "generation", OK: true}
+		var missing []string
+		for _, m := range h.mounts {
+			if m.FileServer() == nil {
+				missing = append(missing, m.prefix)
+			}
+		}
+		if len(missing) > 0 {
+			check.OK = false
+			check.Message = "nothing served at " + strings.Join(missing, ", ")
+		}
+		checks = append(checks, check)
+	}
+
+	if criteria.Build {
+		check := healthCheck{Name: "build", OK: true}
+		var failing []string
+		for _, m := range h.mounts {
+			m.mu.RLock()
+			failingSince := m.failingSince
+			m.mu.RUnlock()
+			if !failingSince.IsZero() && now.Sub(failingSince) >= criteria.BuildGracePeriod {
+				failing = append(failing, fmt.Sprintf("%v since %v", m.prefix, failingSince.Format(time.RFC3339)))
+			}
+		}
+		if len(failing) > 0 {
+			check.OK = false
+			check.Message = "builds failing for " + strings.Join(failing, ", ")
+		}
+		checks = append(checks, check)
+	}
+
+	if criteria.Certificate && h.CertificateExpiry != nil {
+		check := healthCheck{Name: "certificate", OK: true}
+		switch expiry := h.CertificateExpiry(); {
+		case expiry.IsZero():
+			check.OK = false
+			check.Message = "no certificate loaded"
+		case expiry.Sub(now) < criteria.CertificateValidity:
+			check.OK = false
+			check.Message = "certificate expires at " + expiry.Format(time.RFC3339)
+		default:
+			check.Message = "certificate valid until " + expiry.Format(time.RFC3339)
+		}
+		checks = append(checks, check)
+	}
+
+	if criteria.Draining {
+		check := healthCheck{Name: "draining", OK: !h.Draining()}
+		if !check.OK {
+			check.Message = "server is shutting down"
+		}
+		checks = append(checks, check)
+	}
+
+	return checks
+}
+
+// serveHealthz responds to a request to the /.snowweb/healthz endpoint.
+func (h *SnowWebServer) serveHealthz(w http.ResponseWriter, r *http.Request) {
+	h.serveHealth(w, r, h.Liveness)
+}
+
+// serveReadyz responds to a request to the /.snowweb/readyz endpoint.
+func (h *SnowWebServer) serveReadyz(w http.ResponseWriter, r *http.Request) {
+	h.serveHealth(w, r, h.Readiness)
+}
+
+// serveHealth responds to a request to a health endpoint checking the
+// given criteria.  Since it's meant for orchestrators and load
+// balancers, and only tells whether the server is healthy, no
+// authorization is required.
+func (h *SnowWebServer) serveHealth(w http.ResponseWriter, r *http.Request, criteria HealthCriteria) {
+	w.Header().Add("Cache-Control", "no-store")
+	w.Header().Add("Vary", "Accept")
+
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Add("Allow", "GET, HEAD")
+		w.Header().Add("Content-Length", "0")
+		w.WriteHeader(http.StatusNotAcceptable)
+		return
+	}
+
+	response := struct {
+		OK     bool          `json:"ok"`
+		Checks []healthCheck `json:"checks"`
+	}{OK: true, Checks: h.checkHealth(criteria)}
+	for _, check := range response.Checks {
+		response.OK = response.OK && check.OK
+	}
+
+	code := http.StatusOK
+	if !response.OK {
+		code = http.StatusServiceUnavailable
+	}
+	writeAPIResponseStatus(w, r, code, response, func(w io.Writer) {
+		if response.OK {
+			fmt.Fprintf(w, "ok\n")
+		} else {
+			fmt.Fprintf(w, "unhealthy\n")
+		}
+		for _, check := range response.Checks {
+			result := "ok"
+			if !check.OK {
+				result = "failed"
+			}
+			if check.Message != "" {
+				fmt.Fprintf(w, "%v: %v (%v)\n", check.Name, result, check.Message)
+			} else {
+				fmt.Fprintf(w, "%v: %v\n", check.Name, result)
+			}
+		}
+	})
+}
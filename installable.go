@@ -0,0 +1,114 @@
+// SPDX-FileCopyrightText: 2021 Aluísio Augusto Silva Gonçalves <https://aasg.name>
+//
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package snowweb
+
+import (
+	"fmt"
+	"io/fs"
+	"strings"
+)
+
+// DefaultOutput is the derivation output served when none is specified.
+const DefaultOutput = "out"
+
+// An Installable identifies the directory SnowWeb serves: a path
+// within an output of a Nix installable.
+type Installable struct {
+	// Nix installable to build, such as a flake reference.
+	Ref string
+	// Name of the derivation output to serve.  If empty, DefaultOutput
+	// is used.
+	Output string
+	// Path within the output to serve as the site root.  If empty,
+	// the output path itself is served.
+	SubPath string
+}
+
+// ParseInstallable parses an installable specification in the form
+// `INSTALLABLE[^OUTPUT[/SUBPATH]]`.
+//
+// As in Nix, a caret separates the installable from the name of the
+// output to build; it's the first one after the flake output
+// attribute, if any, as the sub-path may contain others.  Since output
+// names cannot contain slashes, anything after the first slash
+// following the output name is taken to be the path under the output
+// to serve.  Only a single output can be served, so lists of outputs,
+// such as `^bin,dev` or `^*`, are rejected.
+func ParseInstallable(s string) (Installable, error) {
+	var i Installable
+
+	start := strings.Index(s, "#")
+	if start == -1 {
+		start = 0
+	}
+	caret := strings.Index(s[start:], "^")
+	if caret == -1 {
+		i.Ref = s
+	} else {
+		caret += start
+		i.Ref = s[:caret]
+		split := strings.SplitN(s[caret+1:], "/", 2)
+		i.Output = split[0]
+		if len(split) == 2 {
+			i.SubPath = strings.Trim(split[1], "/")
+		}
+		if i.Output == "" {
+			return i, fmt.Errorf("snowweb: parsing installable %q: empty output name", s)
+		}
+		if i.Output == "*" || strings.Contains(i.Output, ",") {
+			return i, fmt.Errorf("snowweb: parsing installable %q: only a single output can be served, not %q", s, i.Output)
+		}
+		if strings.Contains(i.Output, "^") {
+			return i, fmt.Errorf("snowweb: parsing installable %q: invalid output name %q", s, i.Output)
+		}
+	}
+
+	if i.Ref == "" {
+		return i, fmt.Errorf("snowweb: parsing installable %q: empty installable", s)
+	}
+	if i.SubPath != "" && !fs.ValidPath(i.SubPath) {
+		return i, fmt.Errorf("snowweb: parsing installable %q: invalid sub-path %q", s, i.SubPath)
+	}
+	return i, nil
+}
+
+// OutputName returns the name of the output to serve, taking defaults
+// into account.
+func (i Installable) OutputName() string {
+	if i.Output == "" {
+		return DefaultOutput
+	}
+	return i.Output
+}
+
+// String formats the Installable in the syntax accepted by
+// ParseInstallable.
+func (i Installable) String() string {
+	s := i.Ref
+	if i.Output != "" || i.SubPath != "" {
+		s += "^" + i.OutputName()
+	}
+	if i.SubPath != "" {
+		s += "/" + i.SubPath
+	}
+	return s
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler by parsing the
+// text with ParseInstallable.
+func (i *Installable) UnmarshalText(text []byte) error {
+	parsed, err := ParseInstallable(string(text))
+	if err != nil {
+		return err
+	}
+	*i = parsed
+	return nil
+}
+
+// MarshalText implements encoding.TextMarshaler by formatting the
+// Installable in the syntax accepted by ParseInstallable.
+func (i Installable) MarshalText() ([]byte, error) {
+	return []byte(i.String()), nil
+}
@@ -25,6 +25,7 @@ var ErrJournaldUnavailable = errors.New("cannot connect to systemd journal socke
 // Supported addresses are:
 // - "stdout" or "stderr", to write to one of the standard streams;
 // - "journald", to write directly to the systemd journal,
+// - "file:PATH", to append JSON lines to a file,
 // - any address supported by sockaddr.SplitNetworkAddress, to write to
 //   a syslog daemon.
 func Writer(address string) (io.Writer, error) {
@@ -43,6 +44,9 @@ func Writer(address string) (io.Writer, error) {
 		if err != nil {
 			return nil, err
 		}
+		if network == "file" {
+			return os.OpenFile(address, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+		}
 
 		syslogWriter, err := syslog.Dial(network, address, syslog.LOG_DAEMON, "snowweb")
 		if err != nil {
@@ -52,3 +56,16 @@ func Writer(address string) (io.Writer, error) {
 		return zerolog.SyslogCEEWriter(syslogWriter), nil
 	}
 }
+
+// JSONWriter is like Writer, but writes to the standard streams the
+// JSON lines it's given, rather than formatting them for humans.
+func JSONWriter(address string) (io.Writer, error) {
+	switch address {
+	case "stderr":
+		return os.Stderr, nil
+	case "stdout":
+		return os.Stdout, nil
+	default:
+		return Writer(address)
+	}
+}
@@ -33,7 +33,7 @@ func (a *ZapToZerologAdapter) Enabled(level zapcore.Level) bool {
 }
 
 func (a *ZapToZerologAdapter) With(fields []zapcore.Field) zapcore.Core {
-	clone := ZapToZerologAdapter{}
+	clone := ZapToZerologAdapter{Logger: a.Logger}
 	return &clone
 }
 
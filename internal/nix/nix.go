@@ -7,23 +7,53 @@
 package nix
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"strings"
 )
 
+// StoreDir is the location of the Nix store.
+var StoreDir = "/nix/store"
+
+func init() {
+	if dir := os.Getenv("NIX_STORE_DIR"); dir != "" {
+		StoreDir = dir
+	}
+}
+
+// IsStorePath checks whether a path is a direct child of the Nix store.
+func IsStorePath(path string) bool {
+	name := strings.TrimPrefix(path, StoreDir+"/")
+	return name != path && name != "" && !strings.Contains(name, "/")
+}
+
 // runNixCommand runs an arbitrary Nix command, and deserializes its
 // JSON output.
-func runNixCommand(result interface{}, args ...string) error {
+//
+// If result is nil, the output of the command is discarded.  If stderr
+// is not nil, the command's diagnostics are copied to it in addition
+// to the standard error stream.  The command is killed if ctx is done
+// before it finishes.
+func runNixCommand(ctx context.Context, result interface{}, stderr io.Writer, args ...string) error {
 	args = append([]string{"--refresh", "--experimental-features", "nix-command flakes"}, args...)
-	cmd := exec.Command("nix", args...)
+	cmd := exec.CommandContext(ctx, "nix", args...)
 	cmd.Stderr = os.Stderr
+	if stderr != nil {
+		cmd.Stderr = io.MultiWriter(os.Stderr, stderr)
+	}
 	out, err := cmd.Output()
 	if err != nil {
 		return &NixCommandError{cmd: cmd, error: err}
 	}
 
+	if result == nil {
+		return nil
+	}
 	if err := json.Unmarshal(out, result); err != nil {
 		return &NixCommandError{cmd: cmd, error: err}
 	}
@@ -31,39 +61,153 @@ func runNixCommand(result interface{}, args ...string) error {
 	return nil
 }
 
-// NarHash returns a cryptographic hash of the NAR serialization of a
-// Nix store path.
-func NarHash(storePath string) (string, error) {
-	var parsedOut []struct {
-		NarHash string `json:"narHash"`
+// PathInfo holds the metadata of a valid Nix store path.
+type PathInfo struct {
+	Path       string   `json:"path"`
+	NarHash    string   `json:"narHash"`
+	NarSize    int64    `json:"narSize"`
+	References []string `json:"references"`
+	Signatures []string `json:"signatures"`
+}
+
+// QueryPathInfo returns the metadata of a Nix store path.
+func QueryPathInfo(storePath string) (*PathInfo, error) {
+	var parsedOut []PathInfo
+	if err := runNixCommand(context.Background(), &parsedOut, nil, "path-info", "--json", storePath); err != nil {
+		return nil, err
 	}
-	if err := runNixCommand(&parsedOut, "path-info", "--json", storePath); err != nil {
-		return "", err
+	if len(parsedOut) == 0 {
+		return nil, fmt.Errorf("snowweb: querying %v: no path information returned", storePath)
+	}
+	return &parsedOut[0], nil
+}
+
+// FlakeMetadata holds the metadata of a flake, as locked by Nix.
+type FlakeMetadata struct {
+	// Locked flake reference.
+	URL string `json:"url"`
+	// Revision of the flake's source, if it's in a version control
+	// repository.
+	Revision string `json:"revision"`
+	// Time of the flake source's last change, as a Unix timestamp.
+	LastModified int64 `json:"lastModified"`
+}
+
+// QueryFlakeMetadata returns the metadata of a flake, locking it to its
+// latest revision, with the given inputs overridden or updated as by
+// Build.  Building the locked reference returned then builds that
+// revision, even if the flake changes in the meantime.
+func QueryFlakeMetadata(ctx context.Context, flakeRef string, overrideInputs map[string]string, updateInputs []string) (*FlakeMetadata, error) {
+	var metadata FlakeMetadata
+	args := append([]string{"flake", "metadata", "--json", flakeRef}, lockFlags(overrideInputs, updateInputs)...)
+	if err := runNixCommand(ctx, &metadata, nil, args...); err != nil {
+		return nil, err
 	}
-	return parsedOut[0].NarHash, nil
+	return &metadata, nil
+}
+
+// lockFlags returns the arguments to Nix commands overriding or updating
+// the given flake inputs.
+func lockFlags(overrideInputs map[string]string, updateInputs []string) []string {
+	var args []string
+	for input, flakeRef := range overrideInputs {
+		args = append(args, "--override-input", input, flakeRef)
+	}
+	for _, input := range updateInputs {
+		args = append(args, "--update-input", input)
+	}
+	// Don't let overrides leak into local flakes' lock files.
+	if len(overrideInputs) > 0 || len(updateInputs) > 0 {
+		args = append(args, "--no-write-lock-file")
+	}
+	return args
+}
+
+// BuildOptions holds optional parameters for Build.
+type BuildOptions struct {
+	// Name of the output whose path is returned.  If empty, the
+	// installable's default outputs are built and the path of the
+	// `out` output is returned.
+	Output string
+	// Nix profile to update if the build succeeds.
+	Profile string
+	// Flake inputs to override, mapping input paths to flake
+	// references.
+	OverrideInputs map[string]string
+	// Flake inputs to update to their latest revision.
+	UpdateInputs []string
+	// Where to copy the build log to, in addition to the standard
+	// error stream.
+	Log io.Writer
 }
 
 // Build builds a Nix flake or other installable, and returns the
-// output path of the built derivation.
-//
-// If a profile path is given, it is passed to `nix build` to be
-// updated if the build succeeds.
-func Build(installable, profile string) (string, error) {
+// path of the requested output of the built derivation.  The build is
+// stopped if ctx is done before it finishes.
+func Build(ctx context.Context, installable string, opts BuildOptions) (string, error) {
 	var parsedOut []struct {
-		Outputs struct {
-			Out string `json:"out"`
-		} `json:"outputs"`
+		Outputs map[string]string `json:"outputs"`
+	}
+
+	output := opts.Output
+	if output != "" {
+		installable += "^" + output
+	} else {
+		output = "out"
 	}
 
 	args := []string{"build", installable, "--json", "--no-link"}
+	if opts.Profile != "" {
+		args = append(args, "--profile", opts.Profile)
+	}
+	args = append(args, lockFlags(opts.OverrideInputs, opts.UpdateInputs)...)
+
+	if err := runNixCommand(ctx, &parsedOut, opts.Log, args...); err != nil {
+		return "", err
+	}
+
+	outPath, ok := parsedOut[0].Outputs[output]
+	if !ok {
+		return "", fmt.Errorf("snowweb: building %v: derivation has no output %q", installable, output)
+	}
+	return outPath, nil
+}
+
+// Substitute fetches a store path from the configured binary caches,
+// if it's not already present in the local store.  Nothing is built
+// locally, and the flake the path came from is never evaluated.
+//
+// If a profile path is given, it is updated to point to the store path.
+// If log is not nil, Nix's diagnostics are copied to it.  Nix is
+// stopped if ctx is done before it finishes.
+func Substitute(ctx context.Context, storePath, profile string, log io.Writer) error {
+	args := []string{"build", storePath, "--no-link", "--max-jobs", "0"}
 	if profile != "" {
 		args = append(args, "--profile", profile)
 	}
 
-	if err := runNixCommand(&parsedOut, args...); err != nil {
-		return "", err
+	return runNixCommand(ctx, nil, log, args...)
+}
+
+// ProfilePath returns the store path a Nix profile points to, following
+// the links to the profile's current generation.
+func ProfilePath(profile string) (string, error) {
+	path := profile
+	// Profiles are a chain of two links, but be lenient.
+	for i := 0; i < 8 && !IsStorePath(path); i++ {
+		target, err := os.Readlink(path)
+		if err != nil {
+			return "", fmt.Errorf("snowweb: reading profile %v: %w", profile, err)
+		}
+		if !filepath.IsAbs(target) {
+			target = filepath.Join(filepath.Dir(path), target)
+		}
+		path = target
+	}
+	if !IsStorePath(path) {
+		return "", fmt.Errorf("snowweb: reading profile %v: %v is not a Nix store path", profile, path)
 	}
-	return parsedOut[0].Outputs.Out, nil
+	return path, nil
 }
 
 // A NixCommandError is returned when running a Nix command fails.
@@ -0,0 +1,126 @@
+// SPDX-FileCopyrightText: 2021 Aluísio Augusto Silva Gonçalves <https://aasg.name>
+//
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package nix
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ErrNoTrustedSignature is returned by VerifySignatures when a store
+// path has no valid signature from any of the trusted keys.
+var ErrNoTrustedSignature = errors.New("no valid signature by a trusted key")
+
+// base32Chars is the alphabet of Nix's base-32 encoding.
+const base32Chars = "0123456789abcdfghijklmnpqrsvwxyz"
+
+// A PublicKey is a named Ed25519 key used to verify signatures of
+// store paths, as in Nix's trusted-public-keys setting.
+type PublicKey struct {
+	Name string
+	Key  ed25519.PublicKey
+}
+
+// ParsePublicKey parses a public key in the `name:base64` format used
+// by Nix.
+func ParsePublicKey(s string) (PublicKey, error) {
+	split := strings.SplitN(s, ":", 2)
+	if len(split) != 2 || split[0] == "" {
+		return PublicKey{}, fmt.Errorf("snowweb: parsing public key %q: expected NAME:KEY", s)
+	}
+
+	key, err := base64.StdEncoding.DecodeString(split[1])
+	if err != nil {
+		return PublicKey{}, fmt.Errorf("snowweb: parsing public key %q: %w", s, err)
+	}
+	if len(key) != ed25519.PublicKeySize {
+		return PublicKey{}, fmt.Errorf("snowweb: parsing public key %q: invalid key size %d", s, len(key))
+	}
+
+	return PublicKey{Name: split[0], Key: ed25519.PublicKey(key)}, nil
+}
+
+// VerifySignatures checks that the store path described by info was
+// signed by at least one of the given keys, and returns the name of
+// the first key found to have signed it.
+//
+// If no signature can be verified, ErrNoTrustedSignature is returned.
+func VerifySignatures(info *PathInfo, keys []PublicKey) (string, error) {
+	fingerprint, err := fingerprintPath(info)
+	if err != nil {
+		return "", err
+	}
+
+	for _, sig := range info.Signatures {
+		split := strings.SplitN(sig, ":", 2)
+		if len(split) != 2 {
+			continue
+		}
+		sigBytes, err := base64.StdEncoding.DecodeString(split[1])
+		if err != nil {
+			continue
+		}
+
+		for _, key := range keys {
+			if key.Name == split[0] && ed25519.Verify(key.Key, []byte(fingerprint), sigBytes) {
+				return key.Name, nil
+			}
+		}
+	}
+
+	return "", fmt.Errorf("snowweb: verifying %v: %w", info.Path, ErrNoTrustedSignature)
+}
+
+// fingerprintPath computes the string signed by Nix to attest the
+// validity of a store path.
+func fingerprintPath(info *PathInfo) (string, error) {
+	narHash, err := base32NarHash(info.NarHash)
+	if err != nil {
+		return "", fmt.Errorf("snowweb: fingerprinting %v: %w", info.Path, err)
+	}
+
+	references := append([]string(nil), info.References...)
+	sort.Strings(references)
+	return "1;" + info.Path + ";" + narHash + ";" + strconv.FormatInt(info.NarSize, 10) + ";" + strings.Join(references, ","), nil
+}
+
+// base32NarHash converts a NAR hash to the `sha256:base32` format used
+// in store path fingerprints.  Both that format and SRI hashes
+// (`sha256-base64`) are accepted as input.
+func base32NarHash(hash string) (string, error) {
+	switch {
+	case strings.HasPrefix(hash, "sha256:"):
+		return hash, nil
+	case strings.HasPrefix(hash, "sha256-"):
+		digest, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(hash, "sha256-"))
+		if err != nil {
+			return "", err
+		}
+		return "sha256:" + encodeBase32(digest), nil
+	default:
+		return "", fmt.Errorf("unsupported NAR hash %q", hash)
+	}
+}
+
+// encodeBase32 encodes a byte string in Nix's base-32 encoding.
+func encodeBase32(data []byte) string {
+	length := (len(data)*8-1)/5 + 1
+	out := make([]byte, 0, length)
+	for n := length - 1; n >= 0; n-- {
+		b := n * 5
+		i, j := b/8, uint(b%8)
+		c := data[i] >> j
+		if i+1 < len(data) {
+			c |= data[i+1] << (8 - j)
+		}
+		out = append(out, base32Chars[c&0x1f])
+	}
+	return string(out)
+}
@@ -37,6 +37,25 @@ func SplitNetworkAddress(s string) (string, string, error) {
 	return split[0], split[1], nil
 }
 
+// ParseIPNetwork parses an IP network in CIDR notation, or a single IP
+// address as a network containing only that address.
+//
+// If the string cannot be parsed, a ParseError is returned.
+func ParseIPNetwork(s string) (*net.IPNet, error) {
+	if ip := net.ParseIP(s); ip != nil {
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 8*net.IPv4len
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, network, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, &ParseError{net.ParseError{Type: "IP network", Text: s}, err}
+	}
+	return network, nil
+}
+
 // FDFile creates an os.File wrapping a file descriptor that can be
 // passed to net.FileConn or net.FileListener.
 //
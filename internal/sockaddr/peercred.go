@@ -0,0 +1,41 @@
+// SPDX-FileCopyrightText: 2021 Aluísio Augusto Silva Gonçalves <https://aasg.name>
+//
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package sockaddr
+
+import (
+	"errors"
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// ErrNotUnixSocket is returned by PeerCredentials when the connection
+// is not made through a Unix domain socket.
+var ErrNotUnixSocket = errors.New("connection is not through a Unix domain socket")
+
+// PeerCredentials returns the credentials of the process at the other
+// end of a Unix domain socket connection, as reported by the
+// SO_PEERCRED socket option.
+func PeerCredentials(c net.Conn) (*unix.Ucred, error) {
+	unixConn, ok := c.(*net.UnixConn)
+	if !ok {
+		return nil, ErrNotUnixSocket
+	}
+
+	rawConn, err := unixConn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	var cred *unix.Ucred
+	var credErr error
+	err = rawConn.Control(func(fd uintptr) {
+		cred, credErr = unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return cred, credErr
+}
@@ -0,0 +1,378 @@
+// SPDX-FileCopyrightText: 2021 Aluísio Augusto Silva Gonçalves <https://aasg.name>
+//
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package sockaddr
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrInvalidProxyHeader is returned when reading from a connection
+// accepted by a ProxyListener whose client did not send a valid PROXY
+// protocol header.
+var ErrInvalidProxyHeader = errors.New("invalid PROXY protocol header")
+
+// proxyV2Signature starts every version 2 PROXY protocol header.
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// maxProxyV1HeaderSize is the maximum length of a version 1 PROXY
+// protocol header, including the line terminator.
+const maxProxyV1HeaderSize = 107
+
+// defaultProxyHeaderTimeout is how long a ProxyListener waits for the
+// PROXY protocol header of a connection by default.
+const defaultProxyHeaderTimeout = 10 * time.Second
+
+// Types of the TLVs of version 2 PROXY protocol headers.
+const (
+	pp2TypeALPN          = 0x01
+	pp2TypeAuthority     = 0x02
+	pp2TypeSSL           = 0x20
+	pp2SubtypeSSLVersion = 0x21
+	pp2SubtypeSSLCN      = 0x22
+	pp2SubtypeSSLCipher  = 0x23
+)
+
+// Flags of the PP2_TYPE_SSL TLV.
+const (
+	pp2ClientSSL      = 0x01
+	pp2ClientCertConn = 0x02
+	pp2ClientCertSess = 0x04
+)
+
+// A ProxyHeader holds the information about a connection relayed by a
+// proxy through the PROXY protocol.
+type ProxyHeader struct {
+	// Addresses of the client and of the server it connected to.  They
+	// are nil if unknown, e.g. for health checks made by the proxy.
+	Source, Destination net.Addr
+	// Application-layer protocol negotiated by the client and the
+	// proxy, if any.
+	ALPN string
+	// Host name the client asked for, usually through TLS SNI.
+	Authority string
+	// TLS connection between the client and the proxy, or nil if the
+	// client did not connect through TLS.
+	TLS *ProxyTLS
+}
+
+// A ProxyTLS describes the TLS connection between a client and a proxy,
+// as reported in a version 2 PROXY protocol header.
+type ProxyTLS struct {
+	// TLS version, e.g. "TLSv1.3".
+	Version string
+	// Cipher suite, e.g. "TLS_AES_128_GCM_SHA256".
+	Cipher string
+	// Whether the client presented a certificate.
+	ClientCertificate bool
+	// Whether the client certificate was verified by the proxy.
+	Verified bool
+	// Subject common name of the client certificate.
+	CommonName string
+}
+
+// A ProxyListener wraps a net.Listener whose clients are proxies that
+// start every connection with a PROXY protocol header (see
+// https://www.haproxy.org/download/2.3/doc/proxy-protocol.txt),
+// reporting the addresses of the original connection as those of the
+// accepted connections.
+//
+// Both version 1 (text) and version 2 (binary) headers are accepted.
+// The header is read when the connection is first read from or its
+// addresses are queried, so that slow clients don't hold up Accept.
+type ProxyListener struct {
+	net.Listener
+	// How long to wait for the header.  If zero, a default of 10
+	// seconds is used.
+	HeaderTimeout time.Duration
+	// Networks from which clients are trusted to send a header.  Other
+	// clients are served as if they connected directly.  If empty, no
+	// clients connecting through IP sockets are trusted.
+	//
+	// Clients connecting through other than IP sockets, such as Unix
+	// domain sockets, are always trusted, as access to the socket is
+	// controlled by the file system.
+	Trusted []*net.IPNet
+}
+
+func (l *ProxyListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if !l.trusted(c.RemoteAddr()) {
+		return c, nil
+	}
+	timeout := l.HeaderTimeout
+	if timeout == 0 {
+		timeout = defaultProxyHeaderTimeout
+	}
+	return &proxyConn{Conn: c, timeout: timeout}, nil
+}
+
+// trusted checks whether a client is trusted to send a PROXY protocol
+// header.
+func (l *ProxyListener) trusted(addr net.Addr) bool {
+	var ip net.IP
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		ip = addr.IP
+	case *net.UnixAddr:
+		return true
+	default:
+		return false
+	}
+	for _, network := range l.Trusted {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ProxyHeaderOf returns the PROXY protocol header received through a
+// connection, or nil if the connection was not accepted by a
+// ProxyListener or its client was not trusted to send one.
+//
+// The header is not available for connections wrapped by others, such
+// as by tls.Server.
+func ProxyHeaderOf(c net.Conn) *ProxyHeader {
+	pc, ok := c.(*proxyConn)
+	if !ok {
+		return nil
+	}
+	pc.readHeader()
+	if pc.err != nil {
+		return nil
+	}
+	return &pc.header
+}
+
+// A proxyConn is a connection whose client starts with a PROXY protocol
+// header.
+type proxyConn struct {
+	net.Conn
+	timeout time.Duration
+
+	once   sync.Once
+	reader *bufio.Reader
+	header ProxyHeader
+	err    error
+}
+
+// readHeader reads the PROXY protocol header, if it hasn't been read
+// yet.
+func (c *proxyConn) readHeader() {
+	c.once.Do(func() {
+		c.reader = bufio.NewReader(c.Conn)
+		if err := c.Conn.SetReadDeadline(time.Now().Add(c.timeout)); err != nil {
+			c.err = err
+			return
+		}
+		c.header, c.err = readProxyHeader(c.reader)
+		if err := c.Conn.SetReadDeadline(time.Time{}); err != nil && c.err == nil {
+			c.err = err
+		}
+	})
+}
+
+func (c *proxyConn) Read(p []byte) (int, error) {
+	c.readHeader()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(p)
+}
+
+func (c *proxyConn) LocalAddr() net.Addr {
+	c.readHeader()
+	if c.header.Destination != nil {
+		return c.header.Destination
+	}
+	return c.Conn.LocalAddr()
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.readHeader()
+	if c.header.Source != nil {
+		return c.header.Source
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// readProxyHeader reads a PROXY protocol header.
+func readProxyHeader(r *bufio.Reader) (ProxyHeader, error) {
+	signature, err := r.Peek(len(proxyV2Signature))
+	switch {
+	case err != nil:
+		return ProxyHeader{}, fmt.Errorf("sockaddr: reading PROXY protocol header: %w", err)
+	case bytes.Equal(signature, proxyV2Signature):
+		return readProxyV2Header(r)
+	case bytes.HasPrefix(signature, []byte("PROXY ")):
+		src, dst, err := readProxyV1Header(r)
+		return ProxyHeader{Source: src, Destination: dst}, err
+	default:
+		return ProxyHeader{}, fmt.Errorf("sockaddr: %w: no PROXY protocol signature", ErrInvalidProxyHeader)
+	}
+}
+
+// readProxyV1Header reads a version 1 PROXY protocol header, in the
+// form `PROXY TCP4 SRCADDR DSTADDR SRCPORT DSTPORT\r\n`.
+func readProxyV1Header(r *bufio.Reader) (src, dst net.Addr, err error) {
+	var line []byte
+	for len(line) < maxProxyV1HeaderSize && !bytes.HasSuffix(line, []byte("\r\n")) {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, nil, fmt.Errorf("sockaddr: reading PROXY protocol header: %w", err)
+		}
+		line = append(line, b)
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, nil, fmt.Errorf("sockaddr: %w: header too long", ErrInvalidProxyHeader)
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, fmt.Errorf("sockaddr: %w: %q", ErrInvalidProxyHeader, line)
+	}
+
+	parse := func(host, port string) (*net.TCPAddr, error) {
+		ip := net.ParseIP(host)
+		n, err := strconv.ParseUint(port, 10, 16)
+		if ip == nil || err != nil {
+			return nil, fmt.Errorf("sockaddr: %w: invalid address %v port %v", ErrInvalidProxyHeader, host, port)
+		}
+		return &net.TCPAddr{IP: ip, Port: int(n)}, nil
+	}
+	srcAddr, err := parse(fields[2], fields[4])
+	if err != nil {
+		return nil, nil, err
+	}
+	dstAddr, err := parse(fields[3], fields[5])
+	if err != nil {
+		return nil, nil, err
+	}
+	return srcAddr, dstAddr, nil
+}
+
+// readProxyV2Header reads a version 2 PROXY protocol header.
+func readProxyV2Header(r *bufio.Reader) (ProxyHeader, error) {
+	var h ProxyHeader
+	header := make([]byte, len(proxyV2Signature)+4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return h, fmt.Errorf("sockaddr: reading PROXY protocol header: %w", err)
+	}
+	versionCommand, family := header[12], header[13]
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return h, fmt.Errorf("sockaddr: reading PROXY protocol header: %w", err)
+	}
+
+	if versionCommand>>4 != 2 {
+		return h, fmt.Errorf("sockaddr: %w: unknown version %v", ErrInvalidProxyHeader, versionCommand>>4)
+	}
+	switch versionCommand & 0xf {
+	case 0x0:
+		// LOCAL: the connection was made by the proxy itself.
+		return h, nil
+	case 0x1:
+		// PROXY: the connection is relayed on behalf of a client.
+	default:
+		return h, fmt.Errorf("sockaddr: %w: unknown command %v", ErrInvalidProxyHeader, versionCommand&0xf)
+	}
+
+	// Only stream sockets are served, so the transport protocol is
+	// not checked.
+	var size int
+	switch family >> 4 {
+	case 0x1:
+		size = 2*net.IPv4len + 4
+	case 0x2:
+		size = 2*net.IPv6len + 4
+	case 0x3:
+		size = 2 * 108
+	default:
+		// AF_UNSPEC: the addresses are unknown.
+	}
+	if len(payload) < size {
+		return h, fmt.Errorf("sockaddr: %w: address block too short", ErrInvalidProxyHeader)
+	}
+
+	switch family >> 4 {
+	case 0x1, 0x2:
+		n := (size - 4) / 2
+		h.Source = &net.TCPAddr{IP: net.IP(payload[:n]), Port: int(binary.BigEndian.Uint16(payload[2*n:]))}
+		h.Destination = &net.TCPAddr{IP: net.IP(payload[n : 2*n]), Port: int(binary.BigEndian.Uint16(payload[2*n+2:]))}
+	case 0x3:
+		h.Source = &net.UnixAddr{Name: string(bytes.TrimRight(payload[:108], "\x00")), Net: "unix"}
+		h.Destination = &net.UnixAddr{Name: string(bytes.TrimRight(payload[108:216], "\x00")), Net: "unix"}
+	}
+
+	err := parseProxyTLVs(payload[size:], func(kind byte, value []byte) error {
+		switch kind {
+		case pp2TypeALPN:
+			h.ALPN = string(value)
+		case pp2TypeAuthority:
+			h.Authority = string(value)
+		case pp2TypeSSL:
+			if len(value) < 5 {
+				return fmt.Errorf("sockaddr: %w: SSL TLV too short", ErrInvalidProxyHeader)
+			}
+			client, verify := value[0], binary.BigEndian.Uint32(value[1:5])
+			if client&pp2ClientSSL == 0 {
+				return nil
+			}
+			h.TLS = &ProxyTLS{
+				ClientCertificate: client&(pp2ClientCertConn|pp2ClientCertSess) != 0,
+			}
+			h.TLS.Verified = h.TLS.ClientCertificate && verify == 0
+			return parseProxyTLVs(value[5:], func(kind byte, value []byte) error {
+				switch kind {
+				case pp2SubtypeSSLVersion:
+					h.TLS.Version = string(value)
+				case pp2SubtypeSSLCN:
+					h.TLS.CommonName = string(value)
+				case pp2SubtypeSSLCipher:
+					h.TLS.Cipher = string(value)
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+	return h, err
+}
+
+// parseProxyTLVs calls f for each type-length-value in the data of a
+// version 2 PROXY protocol header.  Types not known by f should be
+// ignored.
+func parseProxyTLVs(data []byte, f func(kind byte, value []byte) error) error {
+	for len(data) > 0 {
+		if len(data) < 3 {
+			return fmt.Errorf("sockaddr: %w: truncated TLV", ErrInvalidProxyHeader)
+		}
+		kind, length := data[0], int(binary.BigEndian.Uint16(data[1:3]))
+		if len(data) < 3+length {
+			return fmt.Errorf("sockaddr: %w: truncated TLV", ErrInvalidProxyHeader)
+		}
+		if err := f(kind, data[3:3+length]); err != nil {
+			return err
+		}
+		data = data[3+length:]
+	}
+	return nil
+}
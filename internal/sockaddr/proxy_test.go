@@ -0,0 +1,412 @@
+// SPDX-FileCopyrightText: 2021 Aluísio Augusto Silva Gonçalves <https://aasg.name>
+//
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package sockaddr
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// addrString formats an address for comparison, with nil addresses
+// as the empty string.
+func addrString(addr net.Addr) string {
+	if addr == nil || reflect.ValueOf(addr).IsNil() {
+		return ""
+	}
+	return addr.Network() + " " + addr.String()
+}
+
+func TestReadProxyV1Header(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		src, dst string
+		rest     string
+		err      error
+	}{
+		{
+			name:  "TCP4",
+			input: "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\nGET / HTTP/1.1\r\n",
+			src:   "tcp 192.0.2.1:56324",
+			dst:   "tcp 198.51.100.1:443",
+			rest:  "GET / HTTP/1.1\r\n",
+		},
+		{
+			name:  "TCP6",
+			input: "PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n",
+			src:   "tcp [2001:db8::1]:56324",
+			dst:   "tcp [2001:db8::2]:443",
+		},
+		{
+			name:  "UNKNOWN",
+			input: "PROXY UNKNOWN\r\nGET",
+			rest:  "GET",
+		},
+		{
+			name:  "UNKNOWN with addresses",
+			input: "PROXY UNKNOWN ffff:f...f:ffff ffff:f...f:ffff 65535 65535\r\n",
+		},
+		{
+			name:  "maximum length",
+			input: "PROXY TCP6 ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff 65535 65535\r\n",
+			src:   "tcp [ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff]:65535",
+			dst:   "tcp [ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff]:65535",
+		},
+		{
+			name:  "over-long line",
+			input: "PROXY TCP4 " + strings.Repeat("1", 120) + "\r\n",
+			err:   ErrInvalidProxyHeader,
+		},
+		{
+			name:  "missing line terminator",
+			input: "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\n",
+			err:   io.EOF,
+		},
+		{
+			name:  "port out of range",
+			input: "PROXY TCP4 192.0.2.1 198.51.100.1 65536 443\r\n",
+			err:   ErrInvalidProxyHeader,
+		},
+		{
+			name:  "negative port",
+			input: "PROXY TCP4 192.0.2.1 198.51.100.1 56324 -1\r\n",
+			err:   ErrInvalidProxyHeader,
+		},
+		{
+			name:  "non-numeric port",
+			input: "PROXY TCP4 192.0.2.1 198.51.100.1 https 443\r\n",
+			err:   ErrInvalidProxyHeader,
+		},
+		{
+			name:  "invalid address",
+			input: "PROXY TCP4 192.0.2.256 198.51.100.1 56324 443\r\n",
+			err:   ErrInvalidProxyHeader,
+		},
+		{
+			name:  "missing field",
+			input: "PROXY TCP4 192.0.2.1 198.51.100.1 56324\r\n",
+			err:   ErrInvalidProxyHeader,
+		},
+		{
+			name:  "unknown protocol",
+			input: "PROXY UDP4 192.0.2.1 198.51.100.1 56324 443\r\n",
+			err:   ErrInvalidProxyHeader,
+		},
+		{
+			name:  "no signature",
+			input: "GET / HTTP/1.1\r\n\r\n",
+			err:   ErrInvalidProxyHeader,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := bufio.NewReader(strings.NewReader(tt.input))
+			h, err := readProxyHeader(r)
+			if tt.err != nil {
+				if !errors.Is(err, tt.err) {
+					t.Fatalf("got error %v, want %v", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := addrString(h.Source); got != tt.src {
+				t.Errorf("got source %q, want %q", got, tt.src)
+			}
+			if got := addrString(h.Destination); got != tt.dst {
+				t.Errorf("got destination %q, want %q", got, tt.dst)
+			}
+			if rest, _ := io.ReadAll(r); string(rest) != tt.rest {
+				t.Errorf("got %q after header, want %q", rest, tt.rest)
+			}
+		})
+	}
+}
+
+// proxyV2Header builds a version 2 PROXY protocol header.
+func proxyV2Header(versionCommand, family byte, payload ...[]byte) []byte {
+	data := bytes.Join(payload, nil)
+	header := append([]byte(nil), proxyV2Signature...)
+	header = append(header, versionCommand, family, 0, 0)
+	binary.BigEndian.PutUint16(header[len(header)-2:], uint16(len(data)))
+	return append(header, data...)
+}
+
+// proxyTLV builds a type-length-value of a version 2 PROXY protocol
+// header.
+func proxyTLV(kind byte, value ...[]byte) []byte {
+	data := bytes.Join(value, nil)
+	tlv := []byte{kind, 0, 0}
+	binary.BigEndian.PutUint16(tlv[1:], uint16(len(data)))
+	return append(tlv, data...)
+}
+
+// port encodes a port number as in a version 2 PROXY protocol header.
+func port(n uint16) []byte {
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, n)
+	return b
+}
+
+// unixPath encodes a socket path as in a version 2 PROXY protocol
+// header.
+func unixPath(name string) []byte {
+	b := make([]byte, 108)
+	copy(b, name)
+	return b
+}
+
+func TestReadProxyV2Header(t *testing.T) {
+	ipv4 := [][]byte{net.ParseIP("192.0.2.1").To4(), net.ParseIP("198.51.100.1").To4(), port(56324), port(443)}
+	inet := bytes.Join(ipv4, nil)
+	tests := []struct {
+		name     string
+		input    []byte
+		src, dst string
+		alpn     string
+		tls      *ProxyTLS
+		err      error
+	}{
+		{
+			name:  "LOCAL",
+			input: proxyV2Header(0x20, 0x00),
+		},
+		{
+			name:  "LOCAL with addresses",
+			input: proxyV2Header(0x20, 0x11, inet),
+		},
+		{
+			name:  "AF_INET",
+			input: proxyV2Header(0x21, 0x11, inet),
+			src:   "tcp 192.0.2.1:56324",
+			dst:   "tcp 198.51.100.1:443",
+		},
+		{
+			name:  "AF_INET6",
+			input: proxyV2Header(0x21, 0x21, net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2"), port(56324), port(443)),
+			src:   "tcp [2001:db8::1]:56324",
+			dst:   "tcp [2001:db8::2]:443",
+		},
+		{
+			name:  "AF_UNIX",
+			input: proxyV2Header(0x21, 0x31, unixPath("/run/client.sock"), unixPath("/run/server.sock")),
+			src:   "unix /run/client.sock",
+			dst:   "unix /run/server.sock",
+		},
+		{
+			name:  "AF_UNSPEC",
+			input: proxyV2Header(0x21, 0x00),
+		},
+		{
+			name:  "ALPN",
+			input: proxyV2Header(0x21, 0x11, inet, proxyTLV(pp2TypeALPN, []byte("h2")), proxyTLV(0xe0, []byte("ignored"))),
+			src:   "tcp 192.0.2.1:56324",
+			dst:   "tcp 198.51.100.1:443",
+			alpn:  "h2",
+		},
+		{
+			name: "SSL with verified client certificate",
+			input: proxyV2Header(0x21, 0x11, inet, proxyTLV(pp2TypeSSL,
+				[]byte{pp2ClientSSL | pp2ClientCertConn, 0, 0, 0, 0},
+				proxyTLV(pp2SubtypeSSLVersion, []byte("TLSv1.3")),
+				proxyTLV(pp2SubtypeSSLCN, []byte("client")),
+				proxyTLV(pp2SubtypeSSLCipher, []byte("TLS_AES_128_GCM_SHA256")))),
+			src: "tcp 192.0.2.1:56324",
+			dst: "tcp 198.51.100.1:443",
+			tls: &ProxyTLS{
+				Version:           "TLSv1.3",
+				Cipher:            "TLS_AES_128_GCM_SHA256",
+				ClientCertificate: true,
+				Verified:          true,
+				CommonName:        "client",
+			},
+		},
+		{
+			name: "SSL with unverified client certificate",
+			input: proxyV2Header(0x21, 0x11, inet, proxyTLV(pp2TypeSSL,
+				[]byte{pp2ClientSSL | pp2ClientCertSess, 0, 0, 0, 1})),
+			src: "tcp 192.0.2.1:56324",
+			dst: "tcp 198.51.100.1:443",
+			tls: &ProxyTLS{ClientCertificate: true},
+		},
+		{
+			name: "SSL without client certificate",
+			input: proxyV2Header(0x21, 0x11, inet, proxyTLV(pp2TypeSSL,
+				[]byte{pp2ClientSSL, 0, 0, 0, 0})),
+			src: "tcp 192.0.2.1:56324",
+			dst: "tcp 198.51.100.1:443",
+			tls: &ProxyTLS{},
+		},
+		{
+			name: "SSL TLV for plain connection",
+			input: proxyV2Header(0x21, 0x11, inet, proxyTLV(pp2TypeSSL,
+				[]byte{0, 0, 0, 0, 0})),
+			src: "tcp 192.0.2.1:56324",
+			dst: "tcp 198.51.100.1:443",
+		},
+		{
+			name:  "SSL TLV too short",
+			input: proxyV2Header(0x21, 0x11, inet, proxyTLV(pp2TypeSSL, []byte{pp2ClientSSL, 0, 0})),
+			err:   ErrInvalidProxyHeader,
+		},
+		{
+			name: "truncated SSL sub-TLV",
+			input: proxyV2Header(0x21, 0x11, inet, proxyTLV(pp2TypeSSL,
+				[]byte{pp2ClientSSL, 0, 0, 0, 0}, []byte{pp2SubtypeSSLVersion, 0, 7}, []byte("TLS"))),
+			err: ErrInvalidProxyHeader,
+		},
+		{
+			name:  "short address block",
+			input: proxyV2Header(0x21, 0x11, inet[:8]),
+			err:   ErrInvalidProxyHeader,
+		},
+		{
+			name:  "short AF_UNIX address block",
+			input: proxyV2Header(0x21, 0x31, unixPath("/run/client.sock")),
+			err:   ErrInvalidProxyHeader,
+		},
+		{
+			name:  "truncated TLV header",
+			input: proxyV2Header(0x21, 0x11, inet, []byte{pp2TypeALPN, 0}),
+			err:   ErrInvalidProxyHeader,
+		},
+		{
+			name:  "truncated TLV value",
+			input: proxyV2Header(0x21, 0x11, inet, []byte{pp2TypeALPN, 0, 4}, []byte("h2")),
+			err:   ErrInvalidProxyHeader,
+		},
+		{
+			name:  "unknown version",
+			input: proxyV2Header(0x11, 0x11, inet),
+			err:   ErrInvalidProxyHeader,
+		},
+		{
+			name:  "unknown command",
+			input: proxyV2Header(0x22, 0x11, inet),
+			err:   ErrInvalidProxyHeader,
+		},
+		{
+			name:  "truncated payload",
+			input: proxyV2Header(0x21, 0x11, inet)[:len(proxyV2Signature)+4+6],
+			err:   io.ErrUnexpectedEOF,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, err := readProxyHeader(bufio.NewReader(bytes.NewReader(tt.input)))
+			if tt.err != nil {
+				if !errors.Is(err, tt.err) {
+					t.Fatalf("got error %v, want %v", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := addrString(h.Source); got != tt.src {
+				t.Errorf("got source %q, want %q", got, tt.src)
+			}
+			if got := addrString(h.Destination); got != tt.dst {
+				t.Errorf("got destination %q, want %q", got, tt.dst)
+			}
+			if h.ALPN != tt.alpn {
+				t.Errorf("got ALPN %q, want %q", h.ALPN, tt.alpn)
+			}
+			if !reflect.DeepEqual(h.TLS, tt.tls) {
+				t.Errorf("got TLS %+v, want %+v", h.TLS, tt.tls)
+			}
+		})
+	}
+}
+
+func TestProxyListenerTrusted(t *testing.T) {
+	_, private, _ := net.ParseCIDR("10.0.0.0/8")
+	_, documentation, _ := net.ParseCIDR("2001:db8::/32")
+	tests := []struct {
+		name    string
+		trusted []*net.IPNet
+		addr    net.Addr
+		want    bool
+	}{
+		{"trusted IPv4 peer", []*net.IPNet{private, documentation}, &net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 1234}, true},
+		{"trusted IPv6 peer", []*net.IPNet{private, documentation}, &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 1234}, true},
+		{"untrusted IPv4 peer", []*net.IPNet{private, documentation}, &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1234}, false},
+		{"untrusted IPv6 peer", []*net.IPNet{private, documentation}, &net.TCPAddr{IP: net.ParseIP("2001:db9::1"), Port: 1234}, false},
+		{"IPv4-mapped IPv6 peer", []*net.IPNet{private}, &net.TCPAddr{IP: net.ParseIP("::ffff:10.1.2.3"), Port: 1234}, true},
+		{"TCP peer without trusted networks", nil, &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1234}, false},
+		{"Unix peer", nil, &net.UnixAddr{Name: "@", Net: "unix"}, true},
+		{"other peer", []*net.IPNet{private}, &net.UDPAddr{IP: net.ParseIP("10.1.2.3"), Port: 1234}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := &ProxyListener{Trusted: tt.trusted}
+			if got := l.trusted(tt.addr); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProxyListenerUntrustedPeer(t *testing.T) {
+	tests := []struct {
+		name    string
+		trusted string
+		remote  string
+		header  bool
+	}{
+		{"untrusted", "192.0.2.0/24", "127.0.0.1", false},
+		{"trusted", "127.0.0.0/8", "192.0.2.1", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, trusted, _ := net.ParseCIDR(tt.trusted)
+			inner, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Skipf("cannot listen on loopback: %v", err)
+			}
+			l := &ProxyListener{Listener: inner, Trusted: []*net.IPNet{trusted}}
+			defer l.Close()
+
+			client, err := net.Dial("tcp", inner.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+			const request = "GET / HTTP/1.1\r\n"
+			if _, err := io.WriteString(client, "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n"+request); err != nil {
+				t.Fatal(err)
+			}
+			client.(*net.TCPConn).CloseWrite()
+
+			c, err := l.Accept()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			if got := c.RemoteAddr().(*net.TCPAddr).IP.String(); got != tt.remote {
+				t.Errorf("got remote address %v, want %v", got, tt.remote)
+			}
+			if got := ProxyHeaderOf(c) != nil; got != tt.header {
+				t.Errorf("got header %v, want %v", got, tt.header)
+			}
+			// Untrusted clients get their header passed through as is.
+			data, err := io.ReadAll(c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := strings.HasPrefix(string(data), "PROXY "); got == tt.header {
+				t.Errorf("got %q, header passed through: %v", data, got)
+			}
+		})
+	}
+}
@@ -5,6 +5,7 @@
 package sockaddr
 
 import (
+	"context"
 	"net"
 )
 
@@ -39,6 +40,13 @@ func ListenerFromString(s string) (net.Listener, error) {
 // the input string format, and net.Dial and sockaddr.FDName for the
 // supported networks.
 func ConnFromString(s string) (net.Conn, error) {
+	return ConnFromStringContext(context.Background(), s)
+}
+
+// ConnFromStringContext is like ConnFromString, but connects using the
+// provided context, which stops the attempt if it's done before the
+// connection is made.
+func ConnFromStringContext(ctx context.Context, s string) (net.Conn, error) {
 	network, address, err := SplitNetworkAddress(s)
 	if err != nil {
 		return nil, err
@@ -52,6 +60,7 @@ func ConnFromString(s string) (net.Conn, error) {
 		}
 		return net.FileConn(f)
 	default:
-		return net.Dial(network, address)
+		var d net.Dialer
+		return d.DialContext(ctx, network, address)
 	}
 }
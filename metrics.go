@@ -0,0 +1,92 @@
+// SPDX-FileCopyrightText: 2021 Aluísio Augusto Silva Gonçalves <https://aasg.name>
+//
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package snowweb
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+// A metricSample is a value of a metric, with its labels formatted as
+// in the Prometheus text format, e.g. `mount="/"`.
+type metricSample struct {
+	labels string
+	value  float64
+}
+
+// writeMetric writes a metric and its samples in the Prometheus text
+// exposition format.
+func writeMetric(w io.Writer, name, kind, help string, samples ...metricSample) {
+	fmt.Fprintf(w, "# HELP %v %v\n# TYPE %v %v\n", name, help, name, kind)
+	for _, sample := range samples {
+		value := strconv.FormatFloat(sample.value, 'g', -1, 64)
+		if sample.labels == "" {
+			fmt.Fprintf(w, "%v %v\n", name, value)
+		} else {
+			fmt.Fprintf(w, "%v{%v} %v\n", name, sample.labels, value)
+		}
+	}
+}
+
+// MetricsHandler returns an http.Handler that serves only the server's
+// metrics and health endpoints, at both /metrics and /.snowweb/metrics
+// and so on, for use on a listener reachable by monitoring systems.
+func (h *SnowWebServer) MetricsHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		h.Error(ErrorNotFound, w, r)
+	})
+	mux.HandleFunc("/metrics", h.serveMetrics)
+	mux.HandleFunc("/.snowweb/metrics", h.serveMetrics)
+	mux.HandleFunc("/healthz", h.serveHealthz)
+	mux.HandleFunc("/.snowweb/healthz", h.serveHealthz)
+	mux.HandleFunc("/readyz", h.serveReadyz)
+	mux.HandleFunc("/.snowweb/readyz", h.serveReadyz)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Server", "SnowWeb")
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// serveMetrics responds to a request to the /.snowweb/metrics endpoint.
+func (h *SnowWebServer) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Cache-Control", "no-store")
+
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Add("Allow", "GET, HEAD")
+		w.Header().Add("Content-Length", "0")
+		w.WriteHeader(http.StatusNotAcceptable)
+		return
+	}
+	if _, ok := h.authorize(w, r, ActionStatus); !ok {
+		return
+	}
+
+	w.Header().Add("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	h.writeMetrics(w)
+}
+
+// writeMetrics writes the server's metrics in the Prometheus text
+// exposition format.
+func (h *SnowWebServer) writeMetrics(w io.Writer) {
+	var generations []metricSample
+	for _, m := range h.mounts {
+		generations = append(generations, metricSample{fmt.Sprintf("mount=%q", m.prefix), float64(m.status().Generation)})
+	}
+	writeMetric(w, "snowweb_mount_generation", "gauge", "Generation being served by a mount, or 0 if none is.", generations...)
+
+	if h.CertificateExpiry != nil {
+		if expiry := h.CertificateExpiry(); !expiry.IsZero() {
+			writeMetric(w, "snowweb_tls_certificate_expiry_timestamp_seconds", "gauge", "Time the TLS certificate expires at, as a Unix timestamp.", metricSample{"", float64(expiry.Unix())})
+		}
+	}
+
+	if h.RateLimiter != nil {
+		h.RateLimiter.writeMetrics(w)
+	}
+}
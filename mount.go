@@ -0,0 +1,405 @@
+// SPDX-FileCopyrightText: 2021 Aluísio Augusto Silva Gonçalves <https://aasg.name>
+//
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package snowweb
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/textproto"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"git.sr.ht/~aasg/snowweb/internal/nix"
+	"github.com/rs/zerolog/log"
+)
+
+// A mount is an http.Handler that serves the output of a Nix
+// installable under a URL path prefix of a SnowWebServer.
+type mount struct {
+	// Server the mount belongs to, from which settings are taken.
+	server *SnowWebServer
+	// URL path prefix the installable is served under.
+	prefix string
+
+	// Lock held while building, so that concurrent builds of the same
+	// mount don't race to update the profile and file server.
+	buildMu sync.Mutex
+	// Lock protecting the fields below, which change on every build.
+	mu sync.RWMutex
+	// The Nix installable whose output path is served.
+	installable Installable
+	// Site-specific HTTP headers send with every response.
+	extraHeaders textproto.MIMEHeader
+	// Inner Nix store path file server.
+	fileServer *NixStorePathServer
+	// Store paths served by the mount, oldest first.
+	generations []generation
+	// Number of the generation being served, or 0 if none is.
+	currentGeneration int
+	// Output of Nix for the running or last build.
+	buildLog *logBuffer
+	// When the running or last build started, and when the last build
+	// finished.  Dry runs are not counted, here and below.
+	buildStarted, buildFinished time.Time
+	// When the last successful and failed builds finished, and why the
+	// latter failed.
+	lastSuccess, lastFailure time.Time
+	lastError                error
+	// When the first build failed since the last successful one, or the
+	// zero time if the last build succeeded.
+	failingSince time.Time
+}
+
+// validateMountPrefix checks that a URL path prefix can be used for
+// mounting an installable.
+func validateMountPrefix(prefix string) error {
+	switch {
+	case !strings.HasPrefix(prefix, "/") || !strings.HasSuffix(prefix, "/"):
+		return fmt.Errorf("snowweb: mount prefix %q must start and end with a slash", prefix)
+	case strings.HasPrefix(prefix, "/.snowweb/"):
+		return fmt.Errorf("snowweb: mount prefix %q conflicts with the SnowWeb API", prefix)
+	}
+	return nil
+}
+
+func (m *mount) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.RLock()
+	fileServer, extraHeaders := m.fileServer, m.extraHeaders
+	m.mu.RUnlock()
+
+	if fileServer == nil {
+		m.server.Error(ErrorUnavailable, w, r)
+		return
+	}
+
+	responseHeaders := w.Header()
+	for name, values := range extraHeaders {
+		for _, value := range values {
+			responseHeaders.Add(name, value)
+		}
+	}
+
+	fileServer.ServeHTTP(w, r)
+}
+
+// FileServer returns the file server currently in use by the mount, or
+// nil if the installable was not built yet.
+func (m *mount) FileServer() *NixStorePathServer {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.fileServer
+}
+
+// profile returns the path of the Nix profile to update when building
+// the mount's installable.
+//
+// The root mount uses the server's profile directly, while other
+// mounts append their prefix to it, e.g. "/api/v2/" is stored in
+// "profile-api-v2".
+func (m *mount) profile() string {
+	if m.server.Profile == "" {
+		return ""
+	}
+	return m.server.Profile + profileSuffix(m.prefix)
+}
+
+// profileSuffix returns what is appended to the server's profile to
+// name that of the mount at the given prefix.  Different prefixes can
+// have the same suffix, e.g. "/api-v2/" and "/api/v2/", so Mount
+// rejects prefixes whose suffix is already taken.
+func profileSuffix(prefix string) string {
+	if prefix == "/" {
+		return ""
+	}
+	return "-" + strings.ReplaceAll(strings.Trim(prefix, "/"), "/", "-")
+}
+
+// RealiseOptions modifies how a mounted installable is realised.
+type RealiseOptions struct {
+	// Store path to serve instead of building the installable.  It
+	// must be signed by one of the server's trusted keys.
+	StorePath string `json:"storePath,omitempty"`
+	// Flake reference to build instead of the installable's, keeping
+	// the installable's attribute path.
+	FlakeRef string `json:"flakeRef,omitempty"`
+	// Flake inputs to override, mapping input paths to flake
+	// references.
+	OverrideInputs map[string]string `json:"overrideInputs,omitempty"`
+	// Flake inputs to update to their latest revision.
+	UpdateInputs []string `json:"updateInputs,omitempty"`
+	// Whether to only build the installable, without updating the
+	// profile or switching to the result.
+	DryRun bool `json:"dryRun,omitempty"`
+}
+
+// overridesFlake checks whether the options change how a flake is
+// evaluated.
+func (opts RealiseOptions) overridesFlake() bool {
+	return opts.FlakeRef != "" || len(opts.OverrideInputs) > 0 || len(opts.UpdateInputs) > 0
+}
+
+// A BuildEvent describes a mount starting or finishing a build.
+type BuildEvent struct {
+	// URL path prefix of the mount.
+	Mount string
+	// Whether the build is starting, rather than finished.
+	Started bool
+	// Whether the build is a dry run, whose result is not served.
+	DryRun bool
+	// Store path built, if the build succeeded.
+	StorePath string
+	// Generation the store path is served as, if the build succeeded
+	// and was not a dry run.
+	Generation int
+	// Why the build failed, if it did.
+	Err error
+}
+
+// Realise builds the mount's installable and updates the mount to serve
+// the resulting store path, which is returned.
+//
+// If the installable is a store path, it is fetched from a binary
+// cache instead of being built.
+func (m *mount) Realise(opts RealiseOptions) (string, error) {
+	if err := m.server.startBuild(); err != nil {
+		return "", fmt.Errorf("snowweb: building mount %v: %w", m.prefix, err)
+	}
+	defer m.server.finishBuild()
+	m.buildMu.Lock()
+	defer m.buildMu.Unlock()
+
+	if !opts.DryRun {
+		m.mu.Lock()
+		m.buildStarted = time.Now()
+		m.mu.Unlock()
+	}
+	onBuild := m.server.OnBuild
+	if onBuild != nil {
+		onBuild(BuildEvent{Mount: m.prefix, Started: true, DryRun: opts.DryRun})
+	}
+	storePath, err := m.realise(opts)
+	if !opts.DryRun {
+		m.recordBuild(err)
+	}
+	if onBuild == nil {
+		return storePath, err
+	}
+	event := BuildEvent{Mount: m.prefix, DryRun: opts.DryRun, StorePath: storePath, Err: err}
+	if err == nil && !opts.DryRun {
+		event.Generation = m.status().Generation
+	}
+	onBuild(event)
+	return storePath, err
+}
+
+// recordBuild records the outcome of a build that finished just now.
+func (m *mount) recordBuild(err error) {
+	now := time.Now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.buildFinished = now
+	if err == nil {
+		m.lastSuccess = now
+		m.failingSince = time.Time{}
+		return
+	}
+	m.lastFailure, m.lastError = now, err
+	if m.failingSince.IsZero() {
+		m.failingSince = now
+	}
+}
+
+// realise does the work of Realise; m.buildMu must be held.
+func (m *mount) realise(opts RealiseOptions) (string, error) {
+	buildLog := newLogBuffer(maxBuildLogSize)
+	m.mu.Lock()
+	installable := m.installable
+	m.buildLog = buildLog
+	m.mu.Unlock()
+
+	profile := m.profile()
+	if opts.DryRun {
+		profile = ""
+	}
+
+	var storePath string
+	var flake *nix.FlakeMetadata
+	switch {
+	case opts.StorePath != "":
+		if !nix.IsStorePath(opts.StorePath) {
+			return "", fmt.Errorf("snowweb: %q is not a Nix store path", opts.StorePath)
+		}
+		if err := m.substitute(opts.StorePath, profile, true, buildLog); err != nil {
+			return "", err
+		}
+		storePath = opts.StorePath
+
+	case nix.IsStorePath(installable.Ref):
+		if opts.overridesFlake() {
+			return "", fmt.Errorf("snowweb: %v is a store path and cannot be overridden", installable.Ref)
+		}
+		if err := m.substitute(installable.Ref, profile, false, buildLog); err != nil {
+			return "", err
+		}
+		storePath = installable.Ref
+
+	default:
+		ref := installable.Ref
+		if opts.FlakeRef != "" {
+			ref = replaceFlakeRef(ref, opts.FlakeRef)
+		}
+
+		// Lock the flake first and build the locked reference, so that
+		// the revision reported is the one built.
+		flakeRef := ref
+		if i := strings.Index(flakeRef, "#"); i != -1 {
+			flakeRef = flakeRef[:i]
+		}
+		var err error
+		flake, err = nix.QueryFlakeMetadata(m.server.buildCtx, flakeRef, opts.OverrideInputs, opts.UpdateInputs)
+		if err != nil {
+			log.Warn().Err(err).Str("mount", m.prefix).Str("flake", flakeRef).Msg("could not query flake metadata")
+		} else if flake.URL != "" {
+			ref = replaceFlakeRef(ref, flake.URL)
+		}
+
+		// Build the derivation we'll be serving.
+		storePath, err = nix.Build(m.server.buildCtx, ref, nix.BuildOptions{
+			Output:         installable.Output,
+			Profile:        profile,
+			OverrideInputs: opts.OverrideInputs,
+			UpdateInputs:   opts.UpdateInputs,
+			Log:            buildLog,
+		})
+		if err != nil {
+			return "", fmt.Errorf("snowweb: building %v: %w", ref, err)
+		}
+		log.Debug().Str("mount", m.prefix).Str("installable", ref).Str("path", storePath).Msg("built Nix package")
+	}
+
+	if opts.DryRun {
+		log.Info().Str("mount", m.prefix).Str("path", storePath).Msg("not switching to store path in dry run")
+		return storePath, nil
+	}
+	if err := m.serve(storePath, 0); err != nil {
+		return "", err
+	}
+	if flake != nil {
+		m.setFlake(flake)
+	}
+
+	if opts.StorePath != "" {
+		m.pinStorePath(opts.StorePath)
+	}
+	return storePath, nil
+}
+
+// pinStorePath makes later rebuilds keep serving a store path, if the
+// mount's installable is pinned to a store path.
+func (m *mount) pinStorePath(storePath string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if nix.IsStorePath(m.installable.Ref) {
+		m.installable.Ref = storePath
+	}
+}
+
+// replaceFlakeRef replaces the flake reference part of an installable,
+// keeping its attribute path, if any.  Any attribute path in the new
+// flake reference is dropped, so that the installable's is the only
+// one built.
+func replaceFlakeRef(installable, flakeRef string) string {
+	if i := strings.Index(flakeRef, "#"); i != -1 {
+		flakeRef = flakeRef[:i]
+	}
+	if i := strings.Index(installable, "#"); i != -1 {
+		return flakeRef + installable[i:]
+	}
+	return flakeRef
+}
+
+// substitute fetches a store path from a binary cache and checks its
+// signatures against the server's trusted keys, then updates the
+// given profile, if any, to point to it.
+//
+// If requireSignature is false, signatures are only checked if trusted
+// keys were configured.  Nix's output is copied to buildLog.
+func (m *mount) substitute(storePath, profile string, requireSignature bool, buildLog io.Writer) error {
+	keys, err := m.server.trustedKeys()
+	if err != nil {
+		return err
+	}
+	if requireSignature && len(keys) == 0 {
+		return fmt.Errorf("snowweb: substituting %v: %w", storePath, ErrNoTrustedKeys)
+	}
+
+	// Hold off updating the profile until the path is verified.
+	if err := nix.Substitute(m.server.buildCtx, storePath, "", buildLog); err != nil {
+		return fmt.Errorf("snowweb: substituting %v: %w", storePath, err)
+	}
+	log.Debug().Str("mount", m.prefix).Str("path", storePath).Msg("substituted Nix store path")
+
+	if len(keys) > 0 {
+		info, err := nix.QueryPathInfo(storePath)
+		if err != nil {
+			return fmt.Errorf("snowweb: querying %v: %w", storePath, err)
+		}
+		keyName, err := nix.VerifySignatures(info, keys)
+		if err != nil {
+			return err
+		}
+		log.Info().Str("mount", m.prefix).Str("path", storePath).Str("key", keyName).Msg("verified store path signature")
+	}
+
+	if profile != "" {
+		if err := nix.Substitute(m.server.buildCtx, storePath, profile, buildLog); err != nil {
+			return fmt.Errorf("snowweb: updating profile %v: %w", profile, err)
+		}
+	}
+	return nil
+}
+
+// serve updates the mount to serve a store path.  If number is 0, the
+// store path is recorded as a new generation; otherwise it must be the
+// number of the generation the store path was recorded under.
+func (m *mount) serve(storePath string, number int) error {
+	m.mu.RLock()
+	subPath := m.installable.SubPath
+	m.mu.RUnlock()
+
+	// Set up the new static file server.
+	fileServer, err := NewNixStorePathServer(storePath, subPath)
+	if err != nil {
+		return fmt.Errorf("snowweb: creating NixStorePathServer for %q: %w", storePath, err)
+	}
+	fileServer.Error = func(code int, w http.ResponseWriter, r *http.Request) {
+		m.server.Error(code, w, r)
+	}
+	fileServer.AutoIndex = m.server.AutoIndex
+	fileServer.URLPrefix = m.prefix
+
+	// Try reading site-specific headers, if there are any.
+	headersPath := filepath.Join(fileServer.Root(), ".snowweb", "headers")
+	headers, err := readMIMEHeaders(headersPath)
+	if err != nil {
+		return fmt.Errorf("snowweb: reading site-specific headers from %q: %w", headersPath, err)
+	}
+	log.Debug().Str("path", headersPath).Msg("read site-specific headers")
+
+	// Switch to the new derivation.
+	m.mu.Lock()
+	m.fileServer = fileServer
+	m.extraHeaders = headers
+	if number == 0 {
+		number = m.addGeneration(fileServer)
+	}
+	m.currentGeneration = number
+	m.mu.Unlock()
+	log.Info().Str("mount", m.prefix).Str("path", fileServer.StorePath()).Str("root", fileServer.Root()).Int("generation", number).Msg("changed site root")
+	return nil
+}
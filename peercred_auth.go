@@ -0,0 +1,107 @@
+// SPDX-FileCopyrightText: 2021 Aluísio Augusto Silva Gonçalves <https://aasg.name>
+//
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package snowweb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os/user"
+	"strconv"
+
+	"git.sr.ht/~aasg/snowweb/internal/sockaddr"
+)
+
+// connContextKey is the context key under which ConnContext stores the
+// connection a request was received through.
+type connContextKey struct{}
+
+// ConnContext returns a copy of ctx that carries the connection c.
+// It should be set as the ConnContext of http.Servers whose requests
+// are authenticated by connection properties, such as with
+// PeerCredentialAuthenticator.
+func ConnContext(ctx context.Context, c net.Conn) context.Context {
+	return context.WithValue(ctx, connContextKey{}, c)
+}
+
+// requestConn returns the connection a request was received through,
+// or nil if the connection was not stored by ConnContext.
+func requestConn(r *http.Request) net.Conn {
+	c, _ := r.Context().Value(connContextKey{}).(net.Conn)
+	return c
+}
+
+// PeerCredentialAuthenticator authenticates clients connecting through
+// a Unix domain socket by the user and group IDs of their process.
+//
+// A client is accepted if its user ID is in UIDs, or if its primary
+// group or one of its user's supplementary groups is in GIDs.  It is
+// identified by its user name, or its user ID if it has no name.
+type PeerCredentialAuthenticator struct {
+	// User IDs allowed to use the API.
+	UIDs []int
+	// Group IDs allowed to use the API.
+	GIDs []int
+}
+
+func (a *PeerCredentialAuthenticator) Authenticate(r *http.Request) (*Identity, error) {
+	c := requestConn(r)
+	if c == nil {
+		return nil, ErrNoCredentials
+	}
+	cred, err := sockaddr.PeerCredentials(c)
+	switch {
+	case errors.Is(err, sockaddr.ErrNotUnixSocket):
+		return nil, ErrNoCredentials
+	case err != nil:
+		return nil, fmt.Errorf("reading peer credentials: %w", err)
+	}
+
+	uid := strconv.FormatUint(uint64(cred.Uid), 10)
+	id := &Identity{Method: "peer", Name: uid}
+	u, err := user.LookupId(uid)
+	if err == nil {
+		id.Name = u.Username
+	}
+
+	if a.allowedUID(int(cred.Uid)) || a.allowedGID(int(cred.Gid)) {
+		return id, nil
+	}
+	if u != nil {
+		groupIDs, _ := u.GroupIds()
+		for _, gid := range groupIDs {
+			if n, err := strconv.Atoi(gid); err == nil && a.allowedGID(n) {
+				return id, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("peer %v (uid %v, gid %v) not allowed: %w", id.Name, cred.Uid, cred.Gid, ErrInvalidCredentials)
+}
+
+func (a *PeerCredentialAuthenticator) Challenge() string {
+	return ""
+}
+
+// allowedUID checks whether a user ID is in the allowlist.
+func (a *PeerCredentialAuthenticator) allowedUID(uid int) bool {
+	for _, allowed := range a.UIDs {
+		if allowed == uid {
+			return true
+		}
+	}
+	return false
+}
+
+// allowedGID checks whether a group ID is in the allowlist.
+func (a *PeerCredentialAuthenticator) allowedGID(gid int) bool {
+	for _, allowed := range a.GIDs {
+		if allowed == gid {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,219 @@
+// SPDX-FileCopyrightText: 2021 Aluísio Augusto Silva Gonçalves <https://aasg.name>
+//
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package snowweb
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"git.sr.ht/~aasg/snowweb/internal/sockaddr"
+)
+
+// API actions subject to authorization.
+const (
+	ActionStatus   = "status"   // Querying the server status
+	ActionReload   = "reload"   // Rebuilding a mount
+	ActionRollback = "rollback" // Switching a mount back to a previous build
+	ActionPreviews = "previews" // Managing preview builds
+	ActionAudit    = "audit"    // Reading the audit log
+	ActionConfig   = "config"   // Reloading the server configuration
+)
+
+// knownActions lists all actions that can be granted by a Policy.
+var knownActions = []string{ActionStatus, ActionReload, ActionRollback, ActionPreviews, ActionAudit, ActionConfig}
+
+// A Policy grants API actions to clients according to their identity.
+//
+// A client is authorized to perform an action if any rule that matches
+// its identity grants that action.
+type Policy struct {
+	// Actions allowed to all clients, even if they did not
+	// authenticate.
+	Anonymous []string `json:"anonymous"`
+	// Rules granting actions to authenticated clients.
+	Rules []PolicyRule `json:"rules"`
+}
+
+// A PolicyRule grants actions to the clients whose identity matches any
+// of the rule's criteria.
+type PolicyRule struct {
+	// Subject common names of client certificates.
+	CommonNames []string `json:"commonNames"`
+	// DNS names in the subject alternative names of client
+	// certificates.
+	DNSNames []string `json:"dnsNames"`
+	// Email addresses in the subject alternative names of client
+	// certificates.
+	Emails []string `json:"emails"`
+	// URIs in the subject alternative names of client certificates,
+	// such as SPIFFE IDs.
+	URIs []string `json:"uris"`
+	// Base64-encoded SHA-256 hashes of the subject public key info of
+	// client certificates.
+	SPKIFingerprints []string `json:"spkiFingerprints"`
+	// Identities of clients authenticated by other means, in the form
+	// `METHOD:NAME`, e.g. "token:deploy".
+	Identities []string `json:"identities"`
+
+	// Networks, as IP addresses or CIDR ranges, that matching clients
+	// must connect from.  If empty, clients may connect from anywhere.
+	Networks []string `json:"networks"`
+
+	// Actions granted to matching clients.
+	Actions []string `json:"actions"`
+}
+
+// LoadPolicy reads an authorization policy from a JSON file.
+func LoadPolicy(filename string) (*Policy, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("snowweb: loading policy from %v: %w", filename, err)
+	}
+	defer f.Close()
+
+	var p Policy
+	decoder := json.NewDecoder(f)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&p); err != nil {
+		return nil, fmt.Errorf("snowweb: parsing policy from %v: %w", filename, err)
+	}
+	if err := p.Validate(); err != nil {
+		return nil, fmt.Errorf("snowweb: validating policy from %v: %w", filename, err)
+	}
+	return &p, nil
+}
+
+// Validate checks that the policy only grants known actions.
+func (p *Policy) Validate() error {
+	check := func(actions []string) error {
+		for _, action := range actions {
+			if !contains(knownActions, action) {
+				return fmt.Errorf("unknown action %q", action)
+			}
+		}
+		return nil
+	}
+
+	if err := check(p.Anonymous); err != nil {
+		return err
+	}
+	for _, rule := range p.Rules {
+		if err := check(rule.Actions); err != nil {
+			return err
+		}
+		for _, network := range rule.Networks {
+			if _, err := sockaddr.ParseIPNetwork(network); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// AuthorizeRequest checks whether the client with the given identity,
+// which is nil for unauthenticated clients, may perform an action.
+//
+// If it may, the identity's Principal is set to the attribute matched
+// by the policy.
+//
+// AuthorizeRequest can be used as the AuthorizeRequest field of a
+// SnowWebServer.
+func (p *Policy) AuthorizeRequest(r *http.Request, id *Identity, action string) bool {
+	if contains(p.Anonymous, action) {
+		return true
+	}
+	if id == nil {
+		return false
+	}
+
+	for _, rule := range p.Rules {
+		if !contains(rule.Actions, action) || !rule.matchAddress(r) {
+			continue
+		}
+		if principal, ok := rule.match(id); ok {
+			id.Principal = principal
+			return true
+		}
+	}
+	return false
+}
+
+// match checks whether a rule applies to an identity, returning the
+// attribute of the identity that matched.
+func (rule *PolicyRule) match(id *Identity) (string, bool) {
+	if contains(rule.Identities, id.String()) {
+		return id.String(), true
+	}
+
+	crt := id.Certificate
+	if crt == nil {
+		return "", false
+	}
+	if contains(rule.CommonNames, crt.Subject.CommonName) {
+		return "cn:" + crt.Subject.CommonName, true
+	}
+	for _, name := range crt.DNSNames {
+		if containsFold(rule.DNSNames, name) {
+			return "dns:" + name, true
+		}
+	}
+	for _, email := range crt.EmailAddresses {
+		if containsFold(rule.Emails, email) {
+			return "email:" + email, true
+		}
+	}
+	for _, uri := range crt.URIs {
+		if contains(rule.URIs, uri.String()) {
+			return "uri:" + uri.String(), true
+		}
+	}
+	if fingerprint := SPKIFingerprint(crt); contains(rule.SPKIFingerprints, fingerprint) {
+		return "spki:" + fingerprint, true
+	}
+	return "", false
+}
+
+// matchAddress checks whether a request was made from one of the
+// networks a rule is restricted to.
+func (rule *PolicyRule) matchAddress(r *http.Request) bool {
+	if len(rule.Networks) == 0 {
+		return true
+	}
+	ip := net.ParseIP(requestIP(r))
+	if ip == nil {
+		return false
+	}
+	for _, network := range rule.Networks {
+		if n, err := sockaddr.ParseIPNetwork(network); err == nil && n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// SPKIFingerprint returns the base64-encoded SHA-256 hash of the
+// subject public key info of a certificate, as used in policies.
+func SPKIFingerprint(crt *x509.Certificate) string {
+	hash := sha256.Sum256(crt.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(hash[:])
+}
+
+// containsFold checks whether s is one of the given values, ignoring
+// case.
+func containsFold(values []string, s string) bool {
+	for _, value := range values {
+		if strings.EqualFold(value, s) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,33 @@
+// SPDX-FileCopyrightText: 2021 Aluísio Augusto Silva Gonçalves <https://aasg.name>
+//
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package snowweb
+
+import (
+	"net/http"
+
+	"git.sr.ht/~aasg/snowweb/internal/sockaddr"
+)
+
+// ProxiedTLS describes the TLS connection between a client and a proxy
+// that relayed it through the PROXY protocol.
+type ProxiedTLS = sockaddr.ProxyTLS
+
+// RequestProxiedTLS returns the TLS connection between the client of a
+// request and the proxy that relayed it, as reported in the request's
+// PROXY protocol header.  It returns nil if the request was not
+// relayed through the PROXY protocol, if the client did not connect
+// to the proxy through TLS, or if the connection was not stored by
+// ConnContext.
+func RequestProxiedTLS(r *http.Request) *ProxiedTLS {
+	c := requestConn(r)
+	if c == nil {
+		return nil
+	}
+	header := sockaddr.ProxyHeaderOf(c)
+	if header == nil {
+		return nil
+	}
+	return header.TLS
+}
@@ -0,0 +1,326 @@
+// SPDX-FileCopyrightText: 2021 Aluísio Augusto Silva Gonçalves <https://aasg.name>
+//
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package snowweb
+
+import (
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// rateLimitSweepInterval is how often a RateLimiter forgets the clients
+// it no longer needs to keep track of.
+const rateLimitSweepInterval = time.Minute
+
+// ipv6NetworkBits is the length of the IPv6 networks clients are
+// tracked by, rather than by single addresses, as a client is usually
+// assigned a whole /64 network to pick addresses from.
+const ipv6NetworkBits = 64
+
+// A RateLimit configures a token bucket: clients may make Burst
+// requests at once, and then Rate requests per second.
+type RateLimit struct {
+	// Average number of requests allowed per second.  If zero, requests
+	// are not limited.
+	Rate float64
+	// Maximum number of requests allowed at once.  It is raised to 1 if
+	// lower.
+	Burst int
+}
+
+// A RateLimiter throttles API requests by the identity and network
+// address of the client, and locks out addresses from which too many
+// failed authentication attempts are made.
+type RateLimiter struct {
+	// Limit applied to each client network address.
+	PerAddress RateLimit
+	// Limit applied to each authenticated client, across addresses.
+	PerIdentity RateLimit
+	// Number of failed authentication attempts from an address after
+	// which it is locked out.  If zero, addresses are never locked out.
+	LockoutThreshold int
+	// How long an address is locked out for, which is also the window
+	// within which failed attempts are counted.
+	LockoutDuration time.Duration
+
+	mu sync.Mutex
+	// Token buckets, indexed by client IP address or identity.
+	addressBuckets  map[string]*tokenBucket
+	identityBuckets map[string]*tokenBucket
+	// Failed authentication attempts per address, and when the count
+	// was started.
+	failures map[string]*failureCount
+	// Addresses locked out, and until when.
+	lockedOut map[string]time.Time
+	// When clients were last forgotten.
+	lastSweep time.Time
+
+	// Counters reported as metrics.
+	limitedRequests map[string]uint64
+	authFailures    uint64
+	lockouts        uint64
+}
+
+// A tokenBucket tracks the requests made by a client.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// A failureCount tracks the failed authentication attempts made from
+// an address.
+type failureCount struct {
+	count int
+	since time.Time
+}
+
+// take removes a token from the bucket, returning how long the client
+// must wait before retrying if there are none left.
+func (b *tokenBucket) take(limit RateLimit, now time.Time) time.Duration {
+	burst := math.Max(float64(limit.Burst), 1)
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*limit.Rate)
+	b.last = now
+	if b.tokens < 1 {
+		return time.Duration((1 - b.tokens) / limit.Rate * float64(time.Second))
+	}
+	b.tokens--
+	return 0
+}
+
+// init allocates the limiter's maps.  l.mu must be held.
+func (l *RateLimiter) init() {
+	if l.addressBuckets != nil {
+		return
+	}
+	l.addressBuckets = make(map[string]*tokenBucket)
+	l.identityBuckets = make(map[string]*tokenBucket)
+	l.failures = make(map[string]*failureCount)
+	l.lockedOut = make(map[string]time.Time)
+	l.limitedRequests = make(map[string]uint64)
+}
+
+// sweep forgets the clients whose buckets have refilled completely,
+// which are indistinguishable from new ones, along with expired
+// failure counts and lockouts, to keep memory bounded.  It does so at
+// most every rateLimitSweepInterval, so that the cost of going through
+// all clients is spread across requests.  l.mu must be held.
+func (l *RateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < rateLimitSweepInterval {
+		return
+	}
+	l.lastSweep = now
+
+	sweepBuckets(l.addressBuckets, l.PerAddress, now)
+	sweepBuckets(l.identityBuckets, l.PerIdentity, now)
+	for addr, f := range l.failures {
+		if now.Sub(f.since) > l.LockoutDuration {
+			delete(l.failures, addr)
+		}
+	}
+	for addr, until := range l.lockedOut {
+		if !now.Before(until) {
+			delete(l.lockedOut, addr)
+		}
+	}
+}
+
+// sweepBuckets forgets the buckets that have refilled completely under
+// the given limit.
+func sweepBuckets(buckets map[string]*tokenBucket, limit RateLimit, now time.Time) {
+	burst := math.Max(float64(limit.Burst), 1)
+	for key, b := range buckets {
+		if limit.Rate <= 0 || b.tokens+now.Sub(b.last).Seconds()*limit.Rate >= burst {
+			delete(buckets, key)
+		}
+	}
+}
+
+// allow checks whether the client identified by key may make a request
+// under the given limit, returning how long it must wait otherwise.
+// The caller must hold the lock protecting buckets.
+func allow(buckets map[string]*tokenBucket, key string, limit RateLimit, now time.Time) time.Duration {
+	if limit.Rate <= 0 {
+		return 0
+	}
+
+	b, ok := buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: math.Max(float64(limit.Burst), 1), last: now}
+		buckets[key] = b
+	}
+	return b.take(limit, now)
+}
+
+// AllowAddress checks whether a request from the network address of
+// r may proceed, returning how long the client must wait otherwise.
+// Locked out addresses are always rejected.
+//
+// Requests received through other than IP sockets, such as Unix domain
+// sockets, are not limited by address, as all of their clients share
+// the same address.
+func (l *RateLimiter) AllowAddress(r *http.Request) time.Duration {
+	addr := clientNetwork(r)
+	if l == nil || addr == "" {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.init()
+
+	now := time.Now()
+	l.sweep(now)
+	if until, ok := l.lockedOut[addr]; ok {
+		if now.Before(until) {
+			l.limitedRequests["lockout"]++
+			return until.Sub(now)
+		}
+		delete(l.lockedOut, addr)
+	}
+
+	wait := allow(l.addressBuckets, addr, l.PerAddress, now)
+	if wait > 0 {
+		l.limitedRequests["address"]++
+	}
+	return wait
+}
+
+// AllowIdentity checks whether a request from an authenticated client
+// may proceed, returning how long the client must wait otherwise.
+func (l *RateLimiter) AllowIdentity(id *Identity) time.Duration {
+	if l == nil || id == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.init()
+
+	now := time.Now()
+	l.sweep(now)
+	wait := allow(l.identityBuckets, id.String(), l.PerIdentity, now)
+	if wait > 0 {
+		l.limitedRequests["identity"]++
+	}
+	return wait
+}
+
+// FailedAuthentication records a failed authentication attempt from
+// the network address of r.  If the address was locked out as a
+// result, the duration of the lockout is returned.  Like in
+// AllowAddress, only IP addresses are locked out.
+func (l *RateLimiter) FailedAuthentication(r *http.Request) time.Duration {
+	addr := clientNetwork(r)
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.init()
+
+	l.authFailures++
+	if l.LockoutThreshold <= 0 || addr == "" {
+		return 0
+	}
+
+	now := time.Now()
+	l.sweep(now)
+	f, ok := l.failures[addr]
+	if ok && now.Sub(f.since) > l.LockoutDuration {
+		ok = false
+	}
+	if !ok {
+		f = &failureCount{since: now}
+		l.failures[addr] = f
+	}
+	f.count++
+	if f.count < l.LockoutThreshold {
+		return 0
+	}
+
+	delete(l.failures, addr)
+	l.lockedOut[addr] = now.Add(l.LockoutDuration)
+	l.lockouts++
+	return l.LockoutDuration
+}
+
+// Reconfigure changes the limits applied by l to those of settings,
+// keeping track of the requests and authentication attempts already
+// made.
+func (l *RateLimiter) Reconfigure(settings *RateLimiter) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.PerAddress = settings.PerAddress
+	l.PerIdentity = settings.PerIdentity
+	l.LockoutThreshold = settings.LockoutThreshold
+	l.LockoutDuration = settings.LockoutDuration
+}
+
+// writeMetrics writes the limiter's configuration and counters in the
+// Prometheus text format.
+func (l *RateLimiter) writeMetrics(w io.Writer) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	lockedOut := 0
+	for _, until := range l.lockedOut {
+		if now.Before(until) {
+			lockedOut++
+		}
+	}
+
+	writeMetric(w, "snowweb_api_rate_limit_requests_per_second", "gauge", "Average number of API requests allowed per second.",
+		metricSample{`scope="address"`, l.PerAddress.Rate},
+		metricSample{`scope="identity"`, l.PerIdentity.Rate})
+	writeMetric(w, "snowweb_api_rate_limit_burst", "gauge", "Number of API requests allowed at once.",
+		metricSample{`scope="address"`, float64(l.PerAddress.Burst)},
+		metricSample{`scope="identity"`, float64(l.PerIdentity.Burst)})
+	writeMetric(w, "snowweb_api_lockout_threshold", "gauge", "Failed authentication attempts after which an address is locked out.",
+		metricSample{"", float64(l.LockoutThreshold)})
+	writeMetric(w, "snowweb_api_lockout_duration_seconds", "gauge", "How long addresses are locked out for.",
+		metricSample{"", l.LockoutDuration.Seconds()})
+	writeMetric(w, "snowweb_api_rate_limited_requests_total", "counter", "API requests rejected for exceeding a limit.",
+		metricSample{`reason="address"`, float64(l.limitedRequests["address"])},
+		metricSample{`reason="identity"`, float64(l.limitedRequests["identity"])},
+		metricSample{`reason="lockout"`, float64(l.limitedRequests["lockout"])})
+	writeMetric(w, "snowweb_api_authentication_failures_total", "counter", "Failed API authentication attempts.",
+		metricSample{"", float64(l.authFailures)})
+	writeMetric(w, "snowweb_api_lockouts_total", "counter", "Addresses locked out after failed authentication attempts.",
+		metricSample{"", float64(l.lockouts)})
+	writeMetric(w, "snowweb_api_locked_out_addresses", "gauge", "Addresses currently locked out.",
+		metricSample{"", float64(lockedOut)})
+}
+
+// requestIP returns the IP address of the client making a request, or
+// an empty string if it was not made through an IP socket.
+func requestIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		// ForwardedHandler leaves out the port if it's not known.
+		host = r.RemoteAddr
+	}
+	if net.ParseIP(host) == nil {
+		return ""
+	}
+	return host
+}
+
+// clientNetwork returns the key a client making a request is tracked
+// by: its IPv4 address, or the /64 network its IPv6 address is in, or
+// an empty string if it was not made through an IP socket.
+func clientNetwork(r *http.Request) string {
+	ip := net.ParseIP(requestIP(r))
+	if ip == nil {
+		return ""
+	}
+	if ip.To4() != nil {
+		return ip.String()
+	}
+	mask := net.CIDRMask(ipv6NetworkBits, 8*net.IPv6len)
+	return (&net.IPNet{IP: ip.Mask(mask), Mask: mask}).String()
+}
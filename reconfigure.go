@@ -0,0 +1,87 @@
+// SPDX-FileCopyrightText: 2021 Aluísio Augusto Silva Gonçalves <https://aasg.name>
+//
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package snowweb
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// ConfigChanges describes the outcome of reloading the configuration
+// of a server.
+type ConfigChanges struct {
+	// Settings whose changes were applied.
+	Applied []string `json:"applied"`
+	// Settings whose changes only take effect after the server is
+	// restarted.
+	RestartRequired []string `json:"restartRequired"`
+}
+
+// Reconfigure calls f to change the settings of the server while it
+// is serving requests.  Only the fields documented as changeable
+// through Reconfigure may be modified.
+func (h *SnowWebServer) Reconfigure(f func(h *SnowWebServer)) {
+	h.settingsMu.Lock()
+	defer h.settingsMu.Unlock()
+	f(h)
+}
+
+// serveConfig responds to a request to the /.snowweb/config endpoint.
+func (h *SnowWebServer) serveConfig(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Cache-Control", "no-store")
+	w.Header().Add("Vary", "Accept")
+
+	if h.ReloadConfig == nil {
+		h.Error(ErrorNotFound, w, r)
+		return
+	}
+	if r.Method != "POST" {
+		w.Header().Add("Allow", "POST")
+		w.Header().Add("Content-Length", "0")
+		w.WriteHeader(http.StatusNotAcceptable)
+		return
+	}
+
+	log.Info().Str("address", r.RemoteAddr).Msg("processing remote configuration reload request")
+	id, ok := h.authorize(w, r, ActionConfig)
+	if !ok {
+		h.audit(r, id, ActionConfig, "", nil, "", AuditDenied, nil)
+		return
+	}
+
+	changes, err := h.ReloadConfig()
+	if err != nil {
+		log.Error().Err(err).Msg("could not reload configuration")
+		h.audit(r, id, ActionConfig, "", nil, "", AuditFailure, err)
+	} else {
+		h.audit(r, id, ActionConfig, "", nil, "", AuditSuccess, nil)
+	}
+
+	response := struct {
+		OK bool `json:"ok"`
+		ConfigChanges
+		Error string `json:"error,omitempty"`
+	}{OK: err == nil, ConfigChanges: changes}
+	if err != nil {
+		response.Error = err.Error()
+	}
+	writeAPIResponse(w, r, response, func(w io.Writer) {
+		if !response.OK {
+			fmt.Fprintf(w, "error\n%v\n", response.Error)
+			return
+		}
+		fmt.Fprintf(w, "ok\n")
+		if len(changes.Applied) > 0 {
+			fmt.Fprintf(w, "applied %v\n", strings.Join(changes.Applied, ", "))
+		}
+		if len(changes.RestartRequired) > 0 {
+			fmt.Fprintf(w, "restart required for %v\n", strings.Join(changes.RestartRequired, ", "))
+		}
+	})
+}
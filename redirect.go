@@ -0,0 +1,50 @@
+// SPDX-FileCopyrightText: 2021 Aluísio Augusto Silva Gonçalves <https://aasg.name>
+//
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package snowweb
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// An HTTPSRedirect is an http.Handler that redirects every request to
+// the same URL with the https scheme, for use on plain HTTP listeners.
+type HTTPSRedirect struct {
+	// Port the website is served through HTTPS at.  If zero, the
+	// default port is assumed.
+	Port int
+	// Function called to produce an error response if the request
+	// cannot be redirected.  If not set, it defaults to
+	// snowweb.HandleError.
+	Error ErrorHandler
+}
+
+func (h *HTTPSRedirect) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Server", "SnowWeb")
+
+	host := r.Host
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	}
+	host = strings.Trim(host, "[]")
+	if host == "" {
+		errorHandler := h.Error
+		if errorHandler == nil {
+			errorHandler = HandleError
+		}
+		errorHandler(ErrorBadRequest, w, r)
+		return
+	}
+	if h.Port != 0 && h.Port != 443 {
+		host = net.JoinHostPort(host, strconv.Itoa(h.Port))
+	} else if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+
+	// A 308 keeps the method and body of the request, unlike a 301.
+	http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+}
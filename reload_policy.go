@@ -0,0 +1,108 @@
+// SPDX-FileCopyrightText: 2021 Aluísio Augusto Silva Gonçalves <https://aasg.name>
+//
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package snowweb
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// A ReloadPolicy restricts which build parameters remote clients may
+// override through the reload endpoint.  The zero value allows no
+// overrides at all.
+type ReloadPolicy struct {
+	// Prefixes of the paths of flake references clients may build
+	// instead of a mount's installable or use to override its inputs,
+	// such as "github:example/site".
+	FlakeRefs []string
+	// Names of flake inputs clients may override.
+	OverrideInputs []string
+	// Names of flake inputs clients may update.
+	UpdateInputs []string
+}
+
+// Check verifies that the options requested by a client are allowed by
+// the policy, returning an error describing the first violation found.
+func (p ReloadPolicy) Check(opts RealiseOptions) error {
+	if opts.FlakeRef != "" && !p.allowsFlakeRef(opts.FlakeRef) {
+		return fmt.Errorf("snowweb: flake reference %q is not allowed", opts.FlakeRef)
+	}
+	for input, flakeRef := range opts.OverrideInputs {
+		if !contains(p.OverrideInputs, input) {
+			return fmt.Errorf("snowweb: overriding input %q is not allowed", input)
+		}
+		if !p.allowsFlakeRef(flakeRef) {
+			return fmt.Errorf("snowweb: flake reference %q is not allowed", flakeRef)
+		}
+	}
+	for _, input := range opts.UpdateInputs {
+		if !contains(p.UpdateInputs, input) {
+			return fmt.Errorf("snowweb: updating input %q is not allowed", input)
+		}
+	}
+	return nil
+}
+
+// allowsFlakeRef checks whether a client may use a flake reference.
+// Its path must start with one of the policy's prefixes, and the only
+// query parameters it may carry are "ref" and "rev", which select a
+// branch or commit; others, such as "host" or "dir", could point Nix
+// somewhere else entirely.  Fragments, which name flake outputs, are
+// never allowed, and neither are dot segments in its path.
+func (p ReloadPolicy) allowsFlakeRef(flakeRef string) bool {
+	if strings.Contains(flakeRef, "#") {
+		return false
+	}
+	path, rawQuery := flakeRef, ""
+	if i := strings.Index(flakeRef, "?"); i != -1 {
+		path, rawQuery = flakeRef[:i], flakeRef[i+1:]
+	}
+	if rawQuery != "" {
+		query, err := url.ParseQuery(rawQuery)
+		if err != nil {
+			return false
+		}
+		for key, values := range query {
+			if (key != "ref" && key != "rev") || len(values) != 1 {
+				return false
+			}
+		}
+	}
+	// Dot segments could lead a URL out of an allowed prefix.
+	for _, segment := range strings.Split(path, "/") {
+		if unescaped, err := url.PathUnescape(segment); err != nil || unescaped == "." || unescaped == ".." {
+			return false
+		}
+	}
+	return hasAnyPrefix(path, p.FlakeRefs)
+}
+
+// hasAnyPrefix checks whether s starts with any of the given prefixes,
+// taken as whole path segments: the prefix must end s, be followed in
+// it by a slash, or end in one itself.  A prefix of
+// "github:example/site" thus allows "github:example/site/dev" but not
+// "github:example/site-evil".
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if prefix == "" || !strings.HasPrefix(s, prefix) {
+			continue
+		}
+		if len(s) == len(prefix) || strings.HasSuffix(prefix, "/") || s[len(prefix)] == '/' {
+			return true
+		}
+	}
+	return false
+}
+
+// contains checks whether s is one of the given values.
+func contains(values []string, s string) bool {
+	for _, value := range values {
+		if value == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,82 @@
+// SPDX-FileCopyrightText: 2021 Aluísio Augusto Silva Gonçalves <https://aasg.name>
+//
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package snowweb
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrDraining is returned when starting a build or rollback after the
+// server has started shutting down.
+var ErrDraining = errors.New("server is shutting down")
+
+// Drain marks the server as shutting down.  The status endpoint then
+// reports it as draining, with a 503 status so that load balancers stop
+// sending traffic to it, and new builds are refused with ErrDraining.
+func (h *SnowWebServer) Drain() {
+	h.buildsMu.Lock()
+	defer h.buildsMu.Unlock()
+	h.draining = true
+}
+
+// Draining checks whether the server is shutting down.
+func (h *SnowWebServer) Draining() bool {
+	h.buildsMu.Lock()
+	defer h.buildsMu.Unlock()
+	return h.draining
+}
+
+// startBuild records that a build or rollback is starting, unless the
+// server is shutting down.  finishBuild must be called once it finishes.
+func (h *SnowWebServer) startBuild() error {
+	h.buildsMu.Lock()
+	defer h.buildsMu.Unlock()
+	if h.draining {
+		return ErrDraining
+	}
+	h.builds.Add(1)
+	h.runningBuilds++
+	return nil
+}
+
+// finishBuild records that a build or rollback started by startBuild
+// has finished.
+func (h *SnowWebServer) finishBuild() {
+	h.buildsMu.Lock()
+	defer h.buildsMu.Unlock()
+	h.runningBuilds--
+	h.builds.Done()
+}
+
+// WaitBuilds waits for the running builds to finish, or for ctx to be
+// done, in which case its error is returned.  It should only be called
+// after Drain, so that no builds start while waiting.
+func (h *SnowWebServer) WaitBuilds(ctx context.Context) error {
+	h.buildsMu.Lock()
+	running := h.runningBuilds
+	h.buildsMu.Unlock()
+	if running == 0 {
+		return nil
+	}
+
+	done := make(chan struct{})
+	go func() {
+		h.builds.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// CancelBuilds stops the running builds, which fail without changing
+// what's served, and makes later ones fail right away.
+func (h *SnowWebServer) CancelBuilds() {
+	h.cancelBuilds()
+}
@@ -6,14 +6,23 @@ package snowweb
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/fs"
+	"math"
+	"mime"
 	"net/http"
 	"net/textproto"
+	"net/url"
 	"os"
-	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"git.sr.ht/~aasg/snowweb/internal/nix"
 	"github.com/kevinpollet/nego"
@@ -21,103 +30,385 @@ import (
 )
 
 // A SnowWebServer is an http.Handler that serves static files
-// from a Nix store path.
+// from one or more Nix store paths.
 type SnowWebServer struct {
+	// Log of administrative actions requested through the API.  If not
+	// set, actions are not audited and the audit endpoint is disabled.
+	Audit *AuditLog
+	// Authentication methods accepted for API requests, tried in order.
+	// It defaults to authenticating clients by their TLS certificate.
+	// It can be changed through Reconfigure.
+	Authenticators []Authenticator
 	// Function called to check if a request for an API action may be
-	// executed.  If not set, it defaults to snowweb.authorizeRequest.
-	AuthorizeRequest func(r *http.Request) bool
+	// executed by a client, whose identity is nil if it did not
+	// authenticate.  If not set, it defaults to
+	// snowweb.authorizeRequest.  It can be changed through Reconfigure.
+	AuthorizeRequest func(r *http.Request, id *Identity, action string) bool
+	// URL path prefixes under which directories without an index.html
+	// file are served as a listing of their contents.
+	AutoIndex []string
+	// Function called to get when the TLS certificate expires, for
+	// health checks and the status endpoint.  It returns the zero time
+	// if no certificate is loaded.  If not set, the server is assumed
+	// not to use TLS.
+	CertificateExpiry func() time.Time
+	// Whether to serve the SnowWeb API only through the handler
+	// returned by AdminHandler, and not through ServeHTTP.
+	DisablePublicAPI bool
 	// Function called to produce an error response in case an error
 	// happens while handling a request.  If not set, it defaults to
 	// snowweb.HandleError.
 	Error ErrorHandler
-	// Site-specific HTTP headers send with every response.
-	extraHeaders textproto.MIMEHeader
-	// Inner Nix store path file server.
-	fileServer *NixStorePathServer
-	// The Nix installable whose `out` output path is served.
-	installable string
+	// Installables served by the server, sorted by URL path prefix.
+	mounts []*mount
+	// Criteria checked by the healthz and readyz endpoints, telling
+	// whether the server works at all and whether it's ready to serve
+	// traffic.  They default to requiring that every mount is serving a
+	// generation and, for readiness, that the server is not draining.
+	Liveness, Readiness HealthCriteria
+	// Function called when a mount starts or finishes building, e.g. to
+	// report the server's state to a service manager.  It may be called
+	// concurrently for different mounts.
+	OnBuild func(event BuildEvent)
 	// Nix profile to update on a successful build.
 	// If a profile is not set, the served path can be garbage-collected
 	// by Nix.
+	//
+	// Installables mounted under a prefix other than "/" use a separate
+	// profile, named after this one with the prefix appended.
 	Profile string
+	// Function called to re-read the server's configuration when
+	// requested through the API.  If not set, the config endpoint is
+	// disabled.
+	ReloadConfig func() (ConfigChanges, error)
+	// Restrictions on the build parameters clients may pass to the
+	// reload endpoint.  It can be changed through Reconfigure.
+	ReloadPolicy ReloadPolicy
+	// Limits on the rate of API requests and failed authentication
+	// attempts.  If not set, requests are not limited.
+	RateLimiter *RateLimiter
+	// Public keys, in the `name:base64` format used by Nix, trusted to
+	// sign store paths served without being built.  They can be changed
+	// through Reconfigure.
+	TrustedKeys []string
+	// Version of the server, reported by the status endpoint.
+	Version string
+	// When the server was created.
+	startTime time.Time
+	// Lock protecting the fields that can be changed through
+	// Reconfigure.
+	settingsMu sync.RWMutex
+	// Context of the builds, done once they're canceled by
+	// CancelBuilds.
+	buildCtx     context.Context
+	cancelBuilds context.CancelFunc
+	// Lock protecting the fields below.
+	buildsMu sync.Mutex
+	// Builds running or waiting for another build of their mount.
+	builds        sync.WaitGroup
+	runningBuilds int
+	// Whether the server is shutting down, set by Drain.
+	draining bool
+	// HTTP request matcher for the SnowWeb API endpoints.
+	api *http.ServeMux
 	// HTTP request matcher used to split request handling between
 	// regular files and the SnowWeb API.
 	mux *http.ServeMux
 }
 
-// NewSnowWebServer constructs a new SnowWebServer.
+// NewSnowWebServer constructs a new SnowWebServer serving the given
+// installable at the root of the site.
 //
 // After getting a SnowWebServer, Realise must be called to perform the
 // initial build and set the served path before a request comes through.
-func NewSnowWebServer(installable string) *SnowWebServer {
+func NewSnowWebServer(installable Installable) *SnowWebServer {
+	buildCtx, cancelBuilds := context.WithCancel(context.Background())
 	h := SnowWebServer{
+		Authenticators:   []Authenticator{ClientCertificateAuthenticator{}},
 		AuthorizeRequest: authorizeRequest,
 		Error:            HandleError,
-		installable:      installable,
+		Liveness:         HealthCriteria{Generation: true},
+		Readiness:        HealthCriteria{Generation: true, Draining: true},
+		startTime:        time.Now(),
+		buildCtx:         buildCtx,
+		cancelBuilds:     cancelBuilds,
+		api:              http.NewServeMux(),
 		mux:              http.NewServeMux(),
 	}
 
-	h.mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		h.fileServer.ServeHTTP(w, r)
-	})
 	// Block the .snowweb directory, except for the API endpoints
 	// which are handled later on.
-	h.mux.HandleFunc("/.snowweb/", func(w http.ResponseWriter, r *http.Request) {
+	h.api.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		h.Error(ErrorNotFound, w, r)
 	})
 
-	h.mux.HandleFunc("/.snowweb/reload", h.serveReload)
-	h.mux.HandleFunc("/.snowweb/status", h.serveStatus)
+	h.api.HandleFunc("/.snowweb/audit", h.serveAudit)
+	h.api.HandleFunc("/.snowweb/config", h.serveConfig)
+	h.api.HandleFunc("/.snowweb/generations", h.serveGenerations)
+	h.api.HandleFunc("/.snowweb/healthz", h.serveHealthz)
+	h.api.HandleFunc("/.snowweb/logs", h.serveLogs)
+	h.api.HandleFunc("/.snowweb/metrics", h.serveMetrics)
+	h.api.HandleFunc("/.snowweb/readyz", h.serveReadyz)
+	h.api.HandleFunc("/.snowweb/reload", h.serveReload)
+	h.api.HandleFunc("/.snowweb/rollback", h.serveRollback)
+	h.api.HandleFunc("/.snowweb/status", h.serveStatus)
+
+	h.mux.HandleFunc("/.snowweb/", func(w http.ResponseWriter, r *http.Request) {
+		if h.DisablePublicAPI {
+			h.Error(ErrorNotFound, w, r)
+			return
+		}
+		h.api.ServeHTTP(w, r)
+	})
+
+	// The root prefix is always valid.
+	_ = h.Mount("/", installable)
 
 	return &h
 }
 
-func (h *SnowWebServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	// Write out the extra headers before passing the request to our mux
-	// for the actual response.
-	responseHeaders := w.Header()
-	responseHeaders.Add("Server", "SnowWeb")
-	for name, values := range h.extraHeaders {
-		for _, value := range values {
-			responseHeaders.Add(name, value)
+// Mount sets up the server to serve an installable under the given
+// URL path prefix, which must start and end with a slash.  Requests
+// are handled by the mount with the longest matching prefix.  Prefixes
+// that differ only in where slashes and dashes are, such as "/api-v2/"
+// and "/api/v2/", cannot both be mounted, as their profiles would have
+// the same name.
+//
+// Like with NewSnowWebServer, the installable is not built until
+// Realise or RealiseMount is called.
+func (h *SnowWebServer) Mount(prefix string, installable Installable) error {
+	if err := validateMountPrefix(prefix); err != nil {
+		return err
+	}
+	if h.findMount(prefix) != nil {
+		return fmt.Errorf("snowweb: an installable is already mounted at %q", prefix)
+	}
+	for _, m := range h.mounts {
+		if profileSuffix(m.prefix) == profileSuffix(prefix) {
+			return fmt.Errorf("snowweb: mounts at %q and %q would share a Nix profile", m.prefix, prefix)
 		}
 	}
 
+	m := &mount{server: h, prefix: prefix, installable: installable}
+	h.mounts = append(h.mounts, m)
+	sort.Slice(h.mounts, func(i, j int) bool {
+		return h.mounts[i].prefix < h.mounts[j].prefix
+	})
+	h.mux.Handle(prefix, m)
+	return nil
+}
+
+// findMount returns the mount at the given prefix, or nil if there is
+// none.
+func (h *SnowWebServer) findMount(prefix string) *mount {
+	for _, m := range h.mounts {
+		if m.prefix == prefix {
+			return m
+		}
+	}
+	return nil
+}
+
+func (h *SnowWebServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Server", "SnowWeb")
 	h.mux.ServeHTTP(w, r)
 }
 
-// Realise builds the Nix installable and updates the server to serve
-// the resulting store path.
+// AdminHandler returns an http.Handler that serves only the SnowWeb
+// API, for use on a listener separate from the public website.
+func (h *SnowWebServer) AdminHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Server", "SnowWeb")
+		h.api.ServeHTTP(w, r)
+	})
+}
+
+// Realise builds all mounted Nix installables and updates the server
+// to serve the resulting store paths.
+//
+// All installables are built even if some of them fail; the error
+// returned is that of the first failed build.
 func (h *SnowWebServer) Realise() error {
-	// Build the derivation we'll be serving.
-	storePath, err := nix.Build(h.installable, h.Profile)
-	if err != nil {
-		return fmt.Errorf("snowweb: building %v: %w", h.installable, err)
+	var firstErr error
+	for _, m := range h.mounts {
+		if _, err := m.Realise(RealiseOptions{}); err != nil {
+			log.Error().Err(err).Str("mount", m.prefix).Msg("could not build mounted installable")
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
 	}
-	log.Debug().Str("installable", h.installable).Str("path", storePath).Msg("built Nix package")
+	return firstErr
+}
 
-	// Set up the new static file server.
-	fileServer, err := NewNixStorePathServer(storePath)
-	if err != nil {
-		return fmt.Errorf("snowweb: creating NixStorePathServer for %q: %w", storePath, err)
+// RealiseMount builds the Nix installable mounted at the given URL
+// path prefix and updates the server to serve the resulting store
+// path, which is returned.
+func (h *SnowWebServer) RealiseMount(prefix string, opts RealiseOptions) (string, error) {
+	m := h.findMount(prefix)
+	if m == nil {
+		return "", fmt.Errorf("snowweb: no installable is mounted at %q", prefix)
+	}
+	return m.Realise(opts)
+}
+
+// ServePath updates the server to serve a store path under the given
+// URL path prefix without building the installable mounted there,
+// e.g. to keep serving what another server process was serving.  The
+// mount's profile is left untouched.
+func (h *SnowWebServer) ServePath(prefix, storePath string) error {
+	m := h.findMount(prefix)
+	if m == nil {
+		return fmt.Errorf("snowweb: no installable is mounted at %q", prefix)
 	}
-	fileServer.Error = func(code int, w http.ResponseWriter, r *http.Request) {
-		h.Error(code, w, r)
+	if !nix.IsStorePath(storePath) {
+		return fmt.Errorf("snowweb: %q is not a Nix store path", storePath)
 	}
+	m.buildMu.Lock()
+	defer m.buildMu.Unlock()
+	return m.serve(storePath, 0)
+}
 
-	// Try reading site-specific headers, if there are any.
-	headersPath := filepath.Join(storePath, ".snowweb", "headers")
-	headers, err := readMIMEHeaders(headersPath)
+// ServeProfile updates the server to serve the store path the profile
+// of the mount at the given URL path prefix points to, without building
+// the installable mounted there.  The store path is returned.
+func (h *SnowWebServer) ServeProfile(prefix string) (string, error) {
+	m := h.findMount(prefix)
+	if m == nil {
+		return "", fmt.Errorf("snowweb: no installable is mounted at %q", prefix)
+	}
+	profile := m.profile()
+	if profile == "" {
+		return "", errors.New("snowweb: no profile is configured")
+	}
+	storePath, err := nix.ProfilePath(profile)
 	if err != nil {
-		return fmt.Errorf("snowweb: reading site-specific headers from %q: %w", headersPath, err)
+		return "", err
 	}
-	log.Debug().Str("path", headersPath).Msg("read site-specific headers")
+	return storePath, h.ServePath(prefix, storePath)
+}
 
-	// Switch to the new derivation.
-	h.fileServer = fileServer
-	h.extraHeaders = headers
-	log.Info().Str("path", h.fileServer.StorePath()).Msg("changed site root")
-	return nil
+// CurrentGeneration returns the store path served under the given URL
+// path prefix and the number of its generation, or an empty string
+// and 0 if nothing is served there.
+func (h *SnowWebServer) CurrentGeneration(prefix string) (string, int) {
+	m := h.findMount(prefix)
+	if m == nil {
+		return "", 0
+	}
+	status := m.status()
+	return status.Path, status.Generation
+}
+
+// ServedPaths returns the store paths being served, by the URL path
+// prefix of their mount.  Mounts not serving anything are left out.
+func (h *SnowWebServer) ServedPaths() map[string]string {
+	paths := make(map[string]string, len(h.mounts))
+	for _, m := range h.mounts {
+		if fileServer := m.FileServer(); fileServer != nil {
+			paths[m.prefix] = fileServer.StorePath()
+		}
+	}
+	return paths
+}
+
+// trustedKeys parses the server's trusted keys.
+func (h *SnowWebServer) trustedKeys() ([]nix.PublicKey, error) {
+	h.settingsMu.RLock()
+	trustedKeys := h.TrustedKeys
+	h.settingsMu.RUnlock()
+
+	keys := make([]nix.PublicKey, 0, len(trustedKeys))
+	for _, s := range trustedKeys {
+		key, err := nix.ParsePublicKey(s)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// mountStatus describes the state of a mount in API responses.
+type mountStatus struct {
+	Prefix      string `json:"prefix"`
+	Installable string `json:"installable"`
+	Path        string `json:"path,omitempty"`
+	Root        string `json:"root,omitempty"`
+	Generation  int    `json:"generation,omitempty"`
+	// Hash and size of the NAR serialization of the store path.
+	NarHash string `json:"narHash,omitempty"`
+	NarSize int64  `json:"narSize,omitempty"`
+	// Revision and time of last change of the flake the store path was
+	// built from.
+	Revision     string     `json:"revision,omitempty"`
+	LastModified *time.Time `json:"lastModified,omitempty"`
+	// Builds of the mount, if any was started.
+	Build *buildStatus `json:"build,omitempty"`
+}
+
+// buildStatus describes the builds of a mount in API responses.  Dry
+// runs are not counted.
+type buildStatus struct {
+	// Whether a build is running.
+	Running bool `json:"running"`
+	// When the running or last build started, and when the last build
+	// finished and how long it took, in seconds.
+	Started  *time.Time `json:"started,omitempty"`
+	Finished *time.Time `json:"finished,omitempty"`
+	Duration float64    `json:"duration,omitempty"`
+	// When the last successful and failed builds finished, and why the
+	// latter failed.
+	LastSuccess *time.Time `json:"lastSuccess,omitempty"`
+	LastFailure *time.Time `json:"lastFailure,omitempty"`
+	LastError   string     `json:"lastError,omitempty"`
+}
+
+// status returns a description of the mount's state.
+func (m *mount) status() mountStatus {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	status := mountStatus{Prefix: m.prefix, Installable: m.installable.String()}
+	if m.fileServer != nil {
+		status.Path = m.fileServer.StorePath()
+		status.Root = m.fileServer.Root()
+		status.Generation = m.currentGeneration
+		status.NarHash = m.fileServer.NarHash()
+		status.NarSize = m.fileServer.NarSize()
+		for _, g := range m.generations {
+			if g.Number == m.currentGeneration {
+				status.Revision = g.Revision
+				status.LastModified = g.LastModified
+			}
+		}
+	}
+	if !m.buildStarted.IsZero() {
+		build := &buildStatus{
+			Running:     m.buildFinished.Before(m.buildStarted),
+			Started:     optionalTime(m.buildStarted),
+			Finished:    optionalTime(m.buildFinished),
+			LastSuccess: optionalTime(m.lastSuccess),
+			LastFailure: optionalTime(m.lastFailure),
+		}
+		if !build.Running {
+			build.Duration = m.buildFinished.Sub(m.buildStarted).Seconds()
+		}
+		if m.lastError != nil {
+			build.LastError = m.lastError.Error()
+		}
+		status.Build = build
+	}
+	return status
+}
+
+// optionalTime returns a pointer to t, or nil if it's the zero time, so
+// that it's left out of JSON responses.
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
 }
 
 // serveStatus responds to a request to the /.snowweb/status endpoint.
@@ -131,28 +422,100 @@ func (h *SnowWebServer) serveStatus(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusNotAcceptable)
 		return
 	}
+	if _, ok := h.authorize(w, r, ActionStatus); !ok {
+		return
+	}
 
+	draining := h.Draining()
 	response := struct {
-		OK   bool   `json:"ok"`
-		Path string `json:"path"`
-	}{OK: true, Path: h.fileServer.StorePath()}
+		OK       bool `json:"ok"`
+		Draining bool `json:"draining,omitempty"`
+		// Version of the server, when it started and for how long it's
+		// been running, in seconds.
+		Version   string    `json:"version,omitempty"`
+		StartTime time.Time `json:"startTime"`
+		Uptime    float64   `json:"uptime"`
+		// When the TLS certificate expires.
+		CertificateExpiry *time.Time `json:"certificateExpiry,omitempty"`
+		mountStatus
+		Mounts []mountStatus `json:"mounts"`
+	}{
+		OK:        !draining,
+		Draining:  draining,
+		Version:   h.Version,
+		StartTime: h.startTime,
+		Uptime:    time.Since(h.startTime).Seconds(),
+	}
+	if h.CertificateExpiry != nil {
+		response.CertificateExpiry = optionalTime(h.CertificateExpiry())
+	}
+	for _, m := range h.mounts {
+		status := m.status()
+		if m.prefix == "/" {
+			response.mountStatus = status
+		}
+		response.Mounts = append(response.Mounts, status)
+	}
 
-	switch nego.NegotiateContentType(r, "text/plain", "application/json") {
-	case "application/json":
-		data, err := json.Marshal(response)
-		if err != nil {
-			log.Error().Err(err).Msg("could not marshal JSON response to status endpoint")
-			// Fall through to the default response format.
-			break
+	// Tell load balancers to stop sending traffic here.
+	code := http.StatusOK
+	if draining {
+		code = http.StatusServiceUnavailable
+	}
+	writeAPIResponseStatus(w, r, code, response, func(w io.Writer) {
+		if draining {
+			fmt.Fprintf(w, "draining\n")
+		} else {
+			fmt.Fprintf(w, "ok\n")
+		}
+		if response.Version != "" {
+			fmt.Fprintf(w, "version %v\n", response.Version)
 		}
+		fmt.Fprintf(w, "up since %v (%v)\n", response.StartTime.Format(time.RFC3339), time.Since(h.startTime).Round(time.Second))
+		if response.CertificateExpiry != nil {
+			fmt.Fprintf(w, "certificate valid until %v\n", response.CertificateExpiry.Format(time.RFC3339))
+		}
+		for _, status := range response.Mounts {
+			if status.Prefix == "/" {
+				fmt.Fprintf(w, "serving %v\n", status.Root)
+			} else {
+				fmt.Fprintf(w, "serving %v at %v\n", status.Root, status.Prefix)
+			}
+			writeMountStatus(w, status)
+		}
+	})
+}
 
-		w.Header().Add("Content-Type", "application/json")
-		w.Write(data)
-		return
+// writeMountStatus writes the details of a mount's state as indented
+// plain text lines.
+func writeMountStatus(w io.Writer, status mountStatus) {
+	fmt.Fprintf(w, "  installable %v\n", status.Installable)
+	if status.Generation != 0 {
+		fmt.Fprintf(w, "  generation %v, NAR %v (%v bytes)\n", status.Generation, status.NarHash, status.NarSize)
+	}
+	if status.Revision != "" {
+		fmt.Fprintf(w, "  revision %v", status.Revision)
+		if status.LastModified != nil {
+			fmt.Fprintf(w, ", last modified %v", status.LastModified.Format(time.RFC3339))
+		}
+		fmt.Fprintf(w, "\n")
 	}
 
-	// Default response format.
-	fmt.Fprintf(w, "ok\nserving %v\n", response.Path)
+	build := status.Build
+	if build == nil {
+		return
+	}
+	if build.Running {
+		fmt.Fprintf(w, "  building since %v\n", build.Started.Format(time.RFC3339))
+	} else {
+		fmt.Fprintf(w, "  last build started %v, took %v\n", build.Started.Format(time.RFC3339), time.Duration(build.Duration*float64(time.Second)).Round(time.Millisecond))
+	}
+	if build.LastSuccess != nil {
+		fmt.Fprintf(w, "  last succeeded %v\n", build.LastSuccess.Format(time.RFC3339))
+	}
+	if build.LastFailure != nil {
+		fmt.Fprintf(w, "  last failed %v: %v\n", build.LastFailure.Format(time.RFC3339), build.LastError)
+	}
 }
 
 // serveReload responds to a request to the /.snowweb/reload endpoint.
@@ -168,47 +531,192 @@ func (h *SnowWebServer) serveReload(w http.ResponseWriter, r *http.Request) {
 	}
 
 	log.Info().Str("address", r.RemoteAddr).Msg("processing remote rebuild request")
-	if !h.AuthorizeRequest(r) {
+	id, ok := h.authorize(w, r, ActionReload)
+	if !ok {
+		h.audit(r, id, ActionReload, requestMount(r, ""), nil, "", AuditDenied, nil)
+		return
+	}
+
+	req, err := parseReloadRequest(r)
+	if err != nil {
+		log.Error().Err(err).Msg("could not parse remote rebuild request")
+		h.audit(r, id, ActionReload, requestMount(r, ""), nil, "", AuditRejected, err)
+		h.Error(ErrorBadRequest, w, r)
+		return
+	}
+	m := h.findMount(req.Mount)
+	if m == nil {
+		h.audit(r, id, ActionReload, req.Mount, req.RealiseOptions, "", AuditRejected, fmt.Errorf("snowweb: no installable is mounted at %q", req.Mount))
+		h.Error(ErrorNotFound, w, r)
+		return
+	}
+	h.settingsMu.RLock()
+	reloadPolicy := h.ReloadPolicy
+	h.settingsMu.RUnlock()
+	if err := reloadPolicy.Check(req.RealiseOptions); err != nil {
+		log.Error().Err(err).Str("address", r.RemoteAddr).Msg("rejected remote rebuild request")
+		h.audit(r, id, ActionReload, req.Mount, req.RealiseOptions, "", AuditRejected, err)
 		w.Header().Add("Content-Length", "0")
 		w.WriteHeader(http.StatusForbidden)
 		return
 	}
 
-	err := h.Realise()
+	storePath, err := m.Realise(req.RealiseOptions)
 	if err != nil {
-		log.Error().Err(err).Msg("could not rebuild website")
+		log.Error().Err(err).Str("mount", req.Mount).Msg("could not rebuild website")
+		h.audit(r, id, ActionReload, req.Mount, req.RealiseOptions, "", AuditFailure, err)
+	} else {
+		h.audit(r, id, ActionReload, req.Mount, req.RealiseOptions, storePath, AuditSuccess, nil)
 	}
 
 	response := struct {
-		OK    bool   `json:"ok"`
-		Path  string `json:"path,omitempty"`
-		Error error  `json:"error,omitempty"`
-	}{OK: err == nil, Error: err}
-	if err == nil {
-		response.Path = h.fileServer.StorePath()
+		OK     bool   `json:"ok"`
+		Mount  string `json:"mount"`
+		DryRun bool   `json:"dryRun,omitempty"`
+		Path   string `json:"path,omitempty"`
+		Root   string `json:"root,omitempty"`
+		Error  string `json:"error,omitempty"`
+	}{OK: err == nil, Mount: req.Mount, DryRun: req.DryRun}
+	switch {
+	case err != nil:
+		response.Error = err.Error()
+	case req.DryRun:
+		response.Path = storePath
+	default:
+		status := m.status()
+		response.Path = status.Path
+		response.Root = status.Root
 	}
 
+	// TODO: should we not send a 200 when the rebuild fails?
+	writeAPIResponse(w, r, response, func(w io.Writer) {
+		switch {
+		case response.OK && response.DryRun:
+			fmt.Fprintf(w, "ok\nbuilt %v\n", response.Path)
+		case response.OK:
+			fmt.Fprintf(w, "ok\nserving %v\n", response.Root)
+		default:
+			fmt.Fprintf(w, "error\n%v\n", response.Error)
+		}
+	})
+}
+
+// writeAPIResponse sends the response to an API request, either as
+// JSON or as plain text written by writeText, according to the
+// client's preference.
+func writeAPIResponse(w http.ResponseWriter, r *http.Request, response interface{}, writeText func(w io.Writer)) {
+	writeAPIResponseStatus(w, r, http.StatusOK, response, writeText)
+}
+
+// writeAPIResponseStatus is like writeAPIResponse, but sends the given
+// HTTP status code.
+func writeAPIResponseStatus(w http.ResponseWriter, r *http.Request, code int, response interface{}, writeText func(w io.Writer)) {
 	switch nego.NegotiateContentType(r, "text/plain", "application/json") {
 	case "application/json":
 		data, err := json.Marshal(response)
 		if err != nil {
-			log.Error().Err(err).Msg("could not marshal JSON response to status endpoint")
+			log.Error().Err(err).Str("url_path", r.URL.Path).Msg("could not marshal JSON response to API request")
 			// Fall through to the default response format.
 			break
 		}
 
-		// TODO: should we not send a 200 when the rebuild fails?
 		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(code)
 		w.Write(data)
 		return
 	}
 
 	// Default response format.
-	if response.OK {
-		fmt.Fprintf(w, "ok\nserving %v\n", response.Path)
-	} else {
-		fmt.Fprintf(w, "error\n%v\n", response.Error)
+	w.Header().Add("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(code)
+	writeText(w)
+}
+
+// maxRequestBodySize is the maximum size of the body of a request to
+// the SnowWeb API.
+const maxRequestBodySize = 64 << 10
+
+// A reloadRequest holds the parameters accepted by the reload
+// endpoint, which can be sent either as a JSON object or as form
+// values.
+type reloadRequest struct {
+	// URL path prefix of the mount to rebuild.  It can also be passed
+	// in the query string, and defaults to the root mount.
+	Mount string `json:"mount"`
+	// How the mount's installable is to be rebuilt.
+	RealiseOptions
+}
+
+// parseReloadRequest reads the parameters of a request to the reload
+// endpoint from its body.
+func parseReloadRequest(r *http.Request) (reloadRequest, error) {
+	var req reloadRequest
+
+	form, err := decodeRequestBody(r, &req)
+	if err != nil {
+		return req, err
+	}
+	if form != nil {
+		req.Mount = form.Get("mount")
+		req.StorePath = form.Get("storePath")
+		req.FlakeRef = form.Get("flakeRef")
+		req.UpdateInputs = form["updateInput"]
+		// Overrides are given as `overrideInput=INPUT=FLAKEREF`.
+		for _, override := range form["overrideInput"] {
+			split := strings.SplitN(override, "=", 2)
+			if len(split) != 2 {
+				return req, fmt.Errorf("snowweb: invalid input override %q", override)
+			}
+			if req.OverrideInputs == nil {
+				req.OverrideInputs = make(map[string]string)
+			}
+			req.OverrideInputs[split[0]] = split[1]
+		}
+		if dryRun := form.Get("dryRun"); dryRun != "" {
+			if req.DryRun, err = strconv.ParseBool(dryRun); err != nil {
+				return req, fmt.Errorf("snowweb: invalid dryRun value %q: %w", dryRun, err)
+			}
+		}
 	}
+
+	req.Mount = requestMount(r, req.Mount)
+	return req, nil
+}
+
+// decodeRequestBody reads the parameters of an API request from its
+// body.  JSON objects are decoded into v, while form values are parsed
+// and returned for the caller to interpret.
+func decodeRequestBody(r *http.Request, v interface{}) (url.Values, error) {
+	body := http.MaxBytesReader(nil, r.Body, maxRequestBodySize)
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case "application/json":
+		decoder := json.NewDecoder(body)
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(v); err != nil && !errors.Is(err, io.EOF) {
+			return nil, err
+		}
+	case "application/x-www-form-urlencoded", "multipart/form-data":
+		r.Body = body
+		if err := r.ParseMultipartForm(maxRequestBodySize); err != nil && !errors.Is(err, http.ErrNotMultipart) {
+			return nil, err
+		}
+		return r.PostForm, nil
+	}
+	return nil, nil
+}
+
+// requestMount returns the URL path prefix of the mount an API request
+// refers to.  If it was not given in the request body, it is taken
+// from the query string, and defaults to the root mount.
+func requestMount(r *http.Request, mount string) string {
+	if mount == "" {
+		mount = r.URL.Query().Get("mount")
+	}
+	if mount == "" {
+		mount = "/"
+	}
+	return mount
 }
 
 // readMIMEHeaders reads a MIME-style header from a file.
@@ -229,20 +737,110 @@ func readMIMEHeaders(filename string) (textproto.MIMEHeader, error) {
 	return tpReader.ReadMIMEHeader()
 }
 
-// authorizeRequest authorizes API commands by verifying that the
-// connection was made over TLS and that a client certificate was
-// presented and verified.
-func authorizeRequest(r *http.Request) bool {
-	switch {
-	default:
-		crt := r.TLS.VerifiedChains[0][0]
-		log.Info().Str("url_path", r.URL.Path).Stringer("serial", crt.SerialNumber).Msg("authenticated client for remote command")
-		return true
-	case r.TLS == nil:
-		fallthrough
-	case len(r.TLS.VerifiedChains) == 0:
-		fallthrough
-	case len(r.TLS.VerifiedChains[0]) == 0:
-		return false
+// authenticate identifies the client making an API request through
+// the given methods, returning nil if it does not present valid
+// credentials.  If the client presented credentials that could not be
+// verified, the last verification error is returned.
+func authenticate(r *http.Request, authenticators []Authenticator) (*Identity, error) {
+	var authErr error
+	for _, authenticator := range authenticators {
+		id, err := authenticator.Authenticate(r)
+		switch {
+		case errors.Is(err, ErrNoCredentials):
+			continue
+		case errors.Is(err, ErrRequestTooLarge):
+			// The body was consumed, so no other method can verify
+			// the request.
+			return nil, err
+		case err != nil:
+			log.Warn().Err(err).Str("address", r.RemoteAddr).Str("url_path", r.URL.Path).Msg("could not authenticate client for remote command")
+			authErr = err
+			continue
+		}
+
+		event := log.Info().Str("url_path", r.URL.Path).Stringer("identity", id)
+		if id.Certificate != nil {
+			event = event.Stringer("serial", id.Certificate.SerialNumber)
+		}
+		event.Msg("authenticated client for remote command")
+		return id, nil
 	}
+	return nil, authErr
+}
+
+// authorize authenticates the client making an API request, and checks
+// whether it may perform the requested action.  The returned identity
+// is nil if the client is authorized without authenticating.
+//
+// If the client is not authorized, or has exceeded the server's rate
+// limits, an error response is written and false is returned.
+func (h *SnowWebServer) authorize(w http.ResponseWriter, r *http.Request, action string) (*Identity, bool) {
+	if wait := h.RateLimiter.AllowAddress(r); wait > 0 {
+		log.Warn().Str("address", r.RemoteAddr).Str("action", action).Msg("address exceeded rate limit for remote commands or is locked out")
+		tooManyRequests(w, wait)
+		return nil, false
+	}
+
+	h.settingsMu.RLock()
+	authenticators, authorizeRequest := h.Authenticators, h.AuthorizeRequest
+	h.settingsMu.RUnlock()
+
+	id, err := authenticate(r, authenticators)
+	if errors.Is(err, ErrRequestTooLarge) {
+		log.Warn().Str("address", r.RemoteAddr).Str("action", action).Msg("request body too large to authenticate")
+		w.Header().Add("Content-Length", "0")
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		return nil, false
+	}
+	if err != nil {
+		if lockout := h.RateLimiter.FailedAuthentication(r); lockout > 0 {
+			log.Warn().Str("address", r.RemoteAddr).Dur("duration", lockout).Msg("locked out client after failed authentication attempts")
+		}
+	}
+	if wait := h.RateLimiter.AllowIdentity(id); wait > 0 {
+		log.Warn().Stringer("identity", id).Str("action", action).Msg("client exceeded rate limit for remote commands")
+		tooManyRequests(w, wait)
+		return id, false
+	}
+
+	if authorizeRequest(r, id, action) {
+		if id != nil && id.Principal != "" {
+			log.Info().Str("action", action).Stringer("identity", id).Str("principal", id.Principal).Msg("authorized client for remote command")
+		}
+		return id, true
+	}
+
+	w.Header().Add("Content-Length", "0")
+	if id != nil {
+		log.Warn().Str("action", action).Stringer("identity", id).Msg("client not authorized for remote command")
+		w.WriteHeader(http.StatusForbidden)
+		return id, false
+	}
+
+	// Let the client know how it can authenticate, if it's done
+	// through HTTP.  Otherwise, there's nothing the client can do
+	// about it within this request.
+	status := http.StatusForbidden
+	for _, authenticator := range authenticators {
+		if challenge := authenticator.Challenge(); challenge != "" {
+			w.Header().Add("WWW-Authenticate", challenge)
+			status = http.StatusUnauthorized
+		}
+	}
+	w.WriteHeader(status)
+	return nil, false
+}
+
+// tooManyRequests rejects a request from a client that exceeded a rate
+// limit, telling it how long to wait before retrying.
+func tooManyRequests(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Add("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	w.Header().Add("Content-Length", "0")
+	w.WriteHeader(http.StatusTooManyRequests)
+}
+
+// authorizeRequest authorizes any authenticated client to perform all
+// API actions, and unauthenticated clients to query the server status.
+func authorizeRequest(r *http.Request, id *Identity, action string) bool {
+	return id != nil || action == ActionStatus
 }